@@ -2,6 +2,11 @@ package bitfield
 
 type Bitfield []byte
 
+//生成能放下numPieces个piece的空bitfield
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
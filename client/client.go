@@ -1,10 +1,12 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/bingnoi/bittorrent/bitfield"
@@ -16,24 +18,50 @@ type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
-	peer     peers.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	//对方是否支持BEP 10扩展协议，以及对方扩展握手里的内容
+	Extensions   bool
+	MetadataSize int
+	extIDs       map[string]uint8
+	peer         peers.Peer
+	infoHash     [20]byte
+	peerID       [20]byte
+
+	reader *bufio.Reader
+	//写连接的锁，其他协程也会给这个peer发have
+	writeMu sync.Mutex
+
+	//上传相关的状态，choke的决定可能来自别的协程
+	mu         sync.Mutex
+	interested bool
+	amChoking  bool
+	requests   []Request
+
+	//和对方之间的传输速率，choke算法用
+	downRate rateMeter
+	upRate   rateMeter
 }
 
 type handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
-//建立握手
+//建立握手，保留位里声明支持扩展协议
 func NewHandShake(infoHash, peerID [20]byte) *handshake {
-	return &handshake{
+	hs := &handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	hs.Reserved[5] |= extensionBit
+	return hs
+}
+
+//对方是否在保留位里声明了扩展协议
+func (hs *handshake) SupportsExtensions() bool {
+	return hs.Reserved[5]&extensionBit != 0
 }
 
 //这个地方是握手的序列化
@@ -41,7 +69,7 @@ func (hs *handshake) Serialize() []byte {
 	buf := make([]byte, len(hs.Pstr)+49)
 	buf[0] = byte(len(hs.Pstr))
 	copy(buf[1:], hs.Pstr)
-	copy(buf[20:], make([]byte, 8))
+	copy(buf[20:], hs.Reserved[:])
 	copy(buf[28:], hs.InfoHash[:])
 	copy(buf[48:], hs.PeerID[:])
 	return buf
@@ -63,7 +91,7 @@ func ConnectionRead(r io.Reader) (*handshake, error) {
 
 	res, err := ConSerialize(pstrlen, r)
 
-	return res, nil
+	return res, err
 }
 
 func ConSerialize(pstrlen int, r io.Reader) (*handshake, error) {
@@ -84,6 +112,7 @@ func ConSerialize(pstrlen int, r io.Reader) (*handshake, error) {
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	copy(h.Reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 
 	return &h, nil
 }
@@ -109,27 +138,6 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake, er
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
-
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
-	}
-	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
-		return nil, err
-	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
-		return nil, err
-	}
-
-	return msg.Payload, nil
-}
-
-
 //这里是新建一个客户端
 func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
@@ -137,53 +145,143 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bf, err := recvBitfield(conn)
+	c := &Client{
+		Conn:       conn,
+		Choked:     true,
+		Extensions: res.SupportsExtensions(),
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		amChoking:  true,
+		reader:     bufio.NewReader(conn),
+	}
+
+	return c, nil
+}
+
+//对方主动连进来，已经用ConnectionRead读过对方的握手，这里回复我们的握手
+func Accept(conn net.Conn, res *handshake, peerID [20]byte) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	req := NewHandShake(res.InfoHash, peerID)
+	_, err := conn.Write(req.Serialize())
+	conn.SetDeadline(time.Time{})
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	var peer peers.Peer
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	c := &Client{
+		Conn:       conn,
+		Choked:     true,
+		Extensions: res.SupportsExtensions(),
+		peer:       peer,
+		infoHash:   res.InfoHash,
+		peerID:     peerID,
+		amChoking:  true,
+		reader:     bufio.NewReader(conn),
+	}
+
+	return c, nil
+}
+
+func (c *Client) Peer() peers.Peer {
+	return c.peer
 }
 
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
+	msg, err := message.Read(c.reader)
 	return msg, err
 }
 
-func (c *Client) SendRequest(index, begin, length int) error {
-	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+//缓冲区里是否还有没读完的消息
+func (c *Client) Pending() bool {
+	return c.reader.Buffered() > 0
 }
 
-func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
+//最多等待timeout，返回对方是否发来了新消息，超时不会读走半条消息
+func (c *Client) Wait(timeout time.Duration) (bool, error) {
+	if c.Pending() {
+		return true, nil
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	_, err := c.reader.Peek(1)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+//对方一直不读的话写会一直阻塞，其他协程给它发have或者choke时会卡在writeMu上
+const writeTimeout = 30 * time.Second
+
+//写超时或者出错之后直接关掉连接，读这个连接的协程会出错退出
+func (c *Client) send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := c.Conn.Write(msg.Serialize())
+	if err != nil {
+		c.Conn.Close()
+	}
 	return err
 }
 
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.send(message.FormatRequest(index, begin, length))
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.send(message.FormatCancel(index, begin, length))
+}
+
+func (c *Client) SendInterested() error {
+	return c.send(&message.Message{ID: message.MsgInterested})
+}
+
+func (c *Client) SendNotInterested() error {
+	return c.send(&message.Message{ID: message.MsgNotInterested})
+}
+
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.mu.Lock()
+	c.amChoking = false
+	c.mu.Unlock()
+	return c.send(&message.Message{ID: message.MsgUnchoke})
+}
+
+//choke对方之后，对方之前的request都不再处理
+func (c *Client) SendChoke() error {
+	c.mu.Lock()
+	c.amChoking = true
+	c.requests = nil
+	c.mu.Unlock()
+	return c.send(&message.Message{ID: message.MsgChoke})
 }
 
 func (c *Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(message.FormatHave(index))
+}
+
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(message.FormatBitfield(bf))
+}
+
+func (c *Client) SendPiece(index, begin int, data []byte) error {
+	return c.send(message.FormatPiece(index, begin, data))
 }
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	"github.com/bingnoi/bittorrent/message"
+	"github.com/jackpal/bencode-go"
+)
+
+//保留位第6个字节的0x10表示支持BEP 10
+const extensionBit = 0x10
+
+//扩展握手固定使用编号0
+const ExtHandshakeID = 0
+
+//我们这边给各个扩展分配的编号，对方给我们发扩展消息时使用
+var LocalExtensions = map[string]uint8{
+	"ut_metadata": 1,
+}
+
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+}
+
+//发送扩展握手，metadataSize为0表示我们还没有info字典
+func (c *Client) SendExtHandshake(metadataSize int) error {
+	hs := extHandshake{
+		M:            make(map[string]int),
+		MetadataSize: metadataSize,
+		V:            "bingnoi/bittorrent",
+	}
+	for name, id := range LocalExtensions {
+		hs.M[name] = int(id)
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, hs)
+	if err != nil {
+		return err
+	}
+	msg := message.FormatExtended(ExtHandshakeID, buf.Bytes())
+	err = c.send(msg)
+	return err
+}
+
+//处理对方的扩展消息，扩展握手直接记录下来，其余的返回给调用方
+func (c *Client) HandleExtended(msg *message.Message) error {
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if extID != ExtHandshakeID {
+		return nil
+	}
+
+	hs := extHandshake{}
+	err = bencode.Unmarshal(bufio.NewReader(bytes.NewReader(payload)), &hs)
+	if err != nil {
+		return err
+	}
+
+	c.extIDs = make(map[string]uint8)
+	for name, id := range hs.M {
+		//编号0表示对方关闭了这个扩展
+		if id > 0 && id < 256 {
+			c.extIDs[name] = uint8(id)
+		}
+	}
+	c.MetadataSize = hs.MetadataSize
+	return nil
+}
+
+//对方给某个扩展分配的编号，收到对方扩展握手之前都是不支持
+func (c *Client) ExtensionID(name string) (uint8, bool) {
+	id, ok := c.extIDs[name]
+	return id, ok
+}
+
+//按照对方分配的编号发送扩展消息
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id, ok := c.ExtensionID(name)
+	if !ok {
+		return fmt.Errorf("Peer does not support extension %s", name)
+	}
+	msg := message.FormatExtended(id, payload)
+	err := c.send(msg)
+	return err
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+//计算速率用的时间窗口，按秒分桶
+const rateWindow = 20
+
+//最近rateWindow秒内的传输速率
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [rateWindow]int64
+	last    int64
+}
+
+//把过期的桶清零
+func (r *rateMeter) advance(now int64) {
+	if now-r.last >= rateWindow {
+		r.buckets = [rateWindow]int64{}
+	} else {
+		for t := r.last + 1; t <= now; t++ {
+			r.buckets[t%rateWindow] = 0
+		}
+	}
+	r.last = now
+}
+
+func (r *rateMeter) add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().Unix()
+	r.advance(now)
+	r.buckets[now%rateWindow] += int64(n)
+}
+
+//每秒字节数
+func (r *rateMeter) rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(time.Now().Unix())
+	var total int64
+	for _, n := range r.buckets {
+		total += n
+	}
+	return float64(total) / rateWindow
+}
+
+//记录从对方下载的数据量
+func (c *Client) AddDownloaded(n int) {
+	c.downRate.add(n)
+}
+
+//记录上传给对方的数据量
+func (c *Client) AddUploaded(n int) {
+	c.upRate.add(n)
+}
+
+//最近一段时间从对方下载的速率，字节每秒
+func (c *Client) DownloadRate() float64 {
+	return c.downRate.rate()
+}
+
+//最近一段时间上传给对方的速率，字节每秒
+func (c *Client) UploadRate() float64 {
+	return c.upRate.rate()
+}
@@ -0,0 +1,67 @@
+package client
+
+//对方向我们请求的一个block
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+//对方是否对我们的piece感兴趣
+func (c *Client) PeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interested
+}
+
+func (c *Client) SetPeerInterested(interested bool) {
+	c.mu.Lock()
+	c.interested = interested
+	c.mu.Unlock()
+}
+
+//我们当前是否choke了对方
+func (c *Client) AmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+//记录对方的request，被choke的时候直接丢掉
+func (c *Client) QueueRequest(req Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.amChoking {
+		return
+	}
+	for _, r := range c.requests {
+		if r == req {
+			return
+		}
+	}
+	c.requests = append(c.requests, req)
+}
+
+//对方发来cancel，还没发出去的block就不再发送
+func (c *Client) CancelRequest(req Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.requests {
+		if r == req {
+			c.requests = append(c.requests[:i], c.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+//取出下一个要处理的request
+func (c *Client) NextRequest() (Request, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) == 0 {
+		return Request{}, false
+	}
+	req := c.requests[0]
+	c.requests = c.requests[1:]
+	return req, true
+}
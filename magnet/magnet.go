@@ -0,0 +1,182 @@
+/*解析magnet链接，只支持BitTorrent v1的info hash
+magnet:?xt=urn:btih:<hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>&so=<files>
+*/
+
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bingnoi/bittorrent/peers"
+)
+
+const btihPrefix = "urn:btih:"
+
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	//x.pe里直接给出IP的peer
+	Peers []peers.Peer
+	//x.pe里给出域名的peer，host:port形式，连接之前才由ResolvePeers解析
+	Hosts []string
+	//so参数选中的文件范围，为空表示全部，知道文件个数之后由SelectedFiles展开
+	Select []FileRange
+}
+
+//so参数里的一段文件序号，First和Last都包含在内
+type FileRange struct {
+	First int
+	Last  int
+}
+
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Expected magnet link but got scheme %q", u.Scheme)
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+	}
+
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("Magnet link has no urn:btih info hash")
+	}
+
+	for _, pe := range q["x.pe"] {
+		p, err := parsePeer(pe)
+		if err != nil {
+			return nil, err
+		}
+		if p.IP == nil {
+			m.Hosts = append(m.Hosts, pe)
+			continue
+		}
+		m.Peers = append(m.Peers, p)
+	}
+
+	if so := q.Get("so"); so != "" {
+		m.Select, err = ParseSelect(so)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+//info hash可能是40位十六进制，也可能是32位base32
+func parseInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var buf []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("Info hash %q has bad length %d", s, len(s))
+	}
+	if err != nil {
+		return hash, err
+	}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+//x.pe是host:port形式，host是域名时返回的IP为nil，解析时不查DNS
+func parsePeer(s string) (peers.Peer, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	if host == "" {
+		return peers.Peer{}, fmt.Errorf("Peer %q has no host", s)
+	}
+	return peers.Peer{IP: net.ParseIP(host), Port: uint16(n)}, nil
+}
+
+//连接之前解析x.pe里的域名，和直接给出IP的peer一起返回，解析失败的跳过
+func (m *Magnet) ResolvePeers() []peers.Peer {
+	list := append([]peers.Peer(nil), m.Peers...)
+	for _, hostport := range m.Hosts {
+		//Parse里已经检查过格式
+		host, port, _ := net.SplitHostPort(hostport)
+		n, _ := strconv.ParseUint(port, 10, 16)
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			log.Println("Resolve peer", hostport, "failed:", err)
+			continue
+		}
+		list = append(list, peers.Peer{IP: ips[0], Port: uint16(n)})
+	}
+	return list
+}
+
+//so=0,2,4-6 这样的格式，这里只检查语法，文件序号是否越界由SelectedFiles检查
+func ParseSelect(s string) ([]FileRange, error) {
+	var ranges []FileRange
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if first < 0 || last < first {
+			return nil, fmt.Errorf("Bad file range %q", part)
+		}
+		ranges = append(ranges, FileRange{first, last})
+	}
+	return ranges, nil
+}
+
+//把文件范围展开成序号，先和文件个数比较，很大的范围不会被展开
+func SelectedFiles(ranges []FileRange, numFiles int) ([]int, error) {
+	var indexes []int
+	for _, r := range ranges {
+		if r.Last >= numFiles {
+			return nil, fmt.Errorf("File index %d out of range, torrent has %d files", r.Last, numFiles)
+		}
+		for i := r.First; i <= r.Last; i++ {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
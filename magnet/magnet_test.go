@@ -0,0 +1,77 @@
+package magnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testHash = [20]byte{0xc1, 0x2f, 0xe1, 0xc0, 0x6b, 0xba, 0x25, 0x4a, 0x9d, 0xc9, 0xf5, 0x19, 0xb3, 0x35, 0xaa, 0x7c, 0x13, 0x67, 0xa8, 0x8a}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{"hex", "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+		{"hex upper", "magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A"},
+		{"base32", "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK"},
+		{"base32 lower", "magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek"},
+	}
+	for _, tt := range tests {
+		m, err := Parse(tt.uri)
+		require.Nil(t, err, tt.name)
+		assert.Equal(t, testHash, m.InfoHash, tt.name)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=ubuntu.iso" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A6969" +
+		"&x.pe=10.0.0.1:6881&x.pe=%5B2001:db8::1%5D:6882&x.pe=peer.example.com:6883&so=0,2,4-6"
+	m, err := Parse(uri)
+	require.Nil(t, err)
+	assert.Equal(t, "ubuntu.iso", m.Name)
+	assert.Equal(t, []string{"http://tracker.example/announce", "udp://tracker.example:6969"}, m.Trackers)
+	assert.Equal(t, []peers.Peer{
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+	}, m.Peers)
+
+	//域名不在解析时查DNS
+	assert.Equal(t, []string{"peer.example.com:6883"}, m.Hosts)
+	assert.Equal(t, []FileRange{{0, 0}, {2, 2}, {4, 6}}, m.Select)
+}
+
+func TestParseBad(t *testing.T) {
+	tests := []string{
+		"http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=nohash",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=10.0.0.1",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=a",
+	}
+	for _, uri := range tests {
+		_, err := Parse(uri)
+		assert.NotNil(t, err, uri)
+	}
+}
+
+func TestSelectedFiles(t *testing.T) {
+	ranges, err := ParseSelect("0,2,4-6")
+	require.Nil(t, err)
+	files, err := SelectedFiles(ranges, 7)
+	require.Nil(t, err)
+	assert.Equal(t, []int{0, 2, 4, 5, 6}, files)
+
+	//很大的范围在展开之前就被拒绝
+	ranges, err = ParseSelect("0-999999999999")
+	require.Nil(t, err)
+	_, err = SelectedFiles(ranges, 7)
+	assert.NotNil(t, err)
+}
@@ -1,40 +1,283 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+
+	"github.com/bingnoi/bittorrent/magnet"
+	"github.com/bingnoi/bittorrent/p2p"
 	"github.com/bingnoi/bittorrent/torrentfile"
 )
 
 func main() {
 
 	//这部分是处理了空值的情况，防止出现用户不提供完整值的情况
-	inTorrentPath := ""
-	outFilePath := ""
-
-	if os.Args[1] == "" { 
+	if len(os.Args) < 2 || os.Args[1] == "" {
 		log.Println("input file cannot empty!")
 		return
-	} else{
-		inTorrentPath = os.Args[1]
 	}
-	 
-	if len(os.Args) == 2 {
+
+	//子命令
+	switch os.Args[1] {
+	case "verify":
+		verify(os.Args[2:])
+	case "create":
+		create(os.Args[2:])
+	case "scrape":
+		scrape(os.Args[2:])
+	case "seed":
+		seed(os.Args[2:])
+	default:
+		download(os.Args[1:])
+	}
+}
+
+//参数可以是.torrent文件，也可以是magnet链接
+func open(arg string) (torrentfile.TorrentFile, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return torrentfile.OpenMagnet(arg)
+	}
+	return torrentfile.Open(arg)
+}
+
+//下载：[flags] <torrent or magnet> [output]，给了做种参数时下载完成后继续做种
+func download(args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	seed := fs.Bool("seed", false, "keep seeding after download until interrupted")
+	seedRatio := fs.Float64("seed-ratio", 0, "stop seeding when uploaded reaches this multiple of the size")
+	seedTime := fs.Duration("seed-time", 0, "stop seeding after this long")
+	sequential := fs.Bool("sequential", false, "download pieces in order, useful for streaming")
+	selectFiles := fs.String("select", "", "only download these files, like 0,2,4-6")
+	highFiles := fs.String("high", "", "download these files first, like 0,2,4-6")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		log.Fatal("usage: [flags] <torrent or magnet> [output]")
+	}
+	inTorrentPath := fs.Arg(0)
+	outFilePath := ""
+
+	//打开并解析torrent文件或者magnet链接
+	tf, err := open(inTorrentPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//没有给输出路径时用torrent里的名字，多文件torrent就是根目录名
+	if fs.NArg() == 1 {
 		log.Println("output file cannot empty! Set Default name already")
-		outFilePath = "default.iso"
+		outFilePath = tf.Name
 	} else {
-		outFilePath = os.Args[2]
+		outFilePath = fs.Arg(1)
+	}
+
+	var opts *torrentfile.SeedOptions
+	if *seed || *seedRatio > 0 || *seedTime > 0 {
+		opts = &torrentfile.SeedOptions{Ratio: *seedRatio, Time: *seedTime}
 	}
 
-	//打开并解析torrent文件
-	tf, err := torrentfile.Open(inTorrentPath)
+	//文件选择和优先级，序号和torrent里文件的顺序一致
+	if *selectFiles != "" {
+		ranges, err := magnet.ParseSelect(*selectFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files, err := magnet.SelectedFiles(ranges, len(tf.Files))
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = tf.SelectFiles(files)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *highFiles != "" {
+		ranges, err := magnet.ParseSelect(*highFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files, err := magnet.SelectedFiles(ranges, len(tf.Files))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file := range files {
+			err = tf.SetFilePriority(file, p2p.PriorityHigh)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	//下载对应的pieces并完成拼接
+	tf.Sequential = *sequential
+	err = tf.DownloadAndSeed(outFilePath, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+//校验：verify <torrent> <path>，数据不完整时退出码为1
+func verify(args []string) {
+	if len(args) != 2 {
+		log.Fatal("usage: verify <torrent> <path>")
+	}
 
-	//下载对应的pieces并完成拼接
-	err = tf.DownloadToFile(outFilePath)
+	tf, err := torrentfile.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := tf.Verify(args[1])
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	for _, f := range res.Files {
+		if f.Missing > 0 || f.Corrupt > 0 {
+			log.Printf("%s: %d pieces missing, %d pieces corrupt\n", f.Path, f.Missing, f.Corrupt)
+		}
+	}
+	if len(res.Missing) > 0 {
+		log.Println("Missing pieces:", res.Missing)
+	}
+	if len(res.Corrupt) > 0 {
+		log.Println("Corrupt pieces:", res.Corrupt)
+	}
+	if !res.OK() {
+		os.Exit(1)
+	}
+	log.Println("All pieces OK")
+}
+
+//只做种：seed [flags] <torrent> <path>，数据要先通过校验
+func seed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	seedRatio := fs.Float64("seed-ratio", 0, "stop seeding when uploaded reaches this multiple of the size")
+	seedTime := fs.Duration("seed-time", 0, "stop seeding after this long")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatal("usage: seed [flags] <torrent> <path>")
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = tf.Seed(fs.Arg(1), torrentfile.SeedOptions{Ratio: *seedRatio, Time: *seedTime})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//可以重复出现的flag，每次出现追加一个值
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+//生成torrent：create [flags] <file or dir> <output.torrent>
+func create(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers listFlag
+	fs.Var(&trackers, "tracker", "tracker tier, comma separated urls, may be repeated")
+	comment := fs.String("comment", "", "comment")
+	createdBy := fs.String("created-by", "bingnoi/bittorrent", "created by")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes, 0 means auto")
+	private := fs.Bool("private", false, "set the private flag")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatal("usage: create [flags] <file or dir> <output.torrent>")
+	}
+
+	//第一个tracker同时作为announce
+	opts := torrentfile.CreateOptions{
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if len(opts.AnnounceList) > 0 {
+		opts.Announce = opts.AnnounceList[0][0]
+	}
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		opts.AnnounceList = nil
+	}
+
+	buf, err := torrentfile.Create(fs.Arg(0), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(fs.Arg(1), buf, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Torrent created:", fs.Arg(1))
+}
+
+//查询做种情况：scrape <torrent or magnet>...，同一个tracker上的多个info hash一次查完
+func scrape(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: scrape <torrent or magnet>...")
+	}
+
+	var trackers []string
+	hashes := make(map[string][][20]byte)
+	names := make(map[[20]byte]string)
+	for _, arg := range args {
+		var infoHash [20]byte
+		var list []string
+		if strings.HasPrefix(arg, "magnet:") {
+			m, err := magnet.Parse(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			infoHash, list = m.InfoHash, m.Trackers
+		} else {
+			tf, err := torrentfile.Open(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			infoHash, list = tf.InfoHash, tf.Trackers()
+		}
+
+		names[infoHash] = arg
+		for _, tr := range list {
+			if _, ok := hashes[tr]; !ok {
+				trackers = append(trackers, tr)
+			}
+			hashes[tr] = append(hashes[tr], infoHash)
+		}
+	}
+
+	for _, tr := range trackers {
+		res, err := torrentfile.Scrape(tr, hashes[tr])
+		if err != nil {
+			log.Println(tr, "failed:", err)
+			continue
+		}
+		for _, h := range hashes[tr] {
+			r, ok := res[h]
+			if !ok {
+				log.Printf("%s %s: unknown to tracker\n", tr, names[h])
+				continue
+			}
+			log.Printf("%s %s: %d seeders, %d leechers, %d completed\n", tr, names[h], r.Complete, r.Incomplete, r.Downloaded)
+		}
+	}
 }
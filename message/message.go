@@ -20,8 +20,13 @@ const (
 	MsgRequest messageID = 6
 	MsgPiece messageID = 7
 	MsgCancel messageID = 8
+	MsgExtended messageID = 20
 )
 
+//最长的消息是128KiB请求对应的piece消息，bitfield也远小于这个长度，
+//超过的直接拒绝，避免对方发一个很大的长度让我们分配内存
+const MaxLength = 1 << 20
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -35,12 +40,64 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+func FormatPiece(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func FormatBitfield(bf []byte) *Message {
+	payload := make([]byte, len(bf))
+	copy(payload, bf)
+	return &Message{ID: MsgBitfield, Payload: payload}
+}
+
+//request和cancel的payload格式相同
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("Expected request or cancel but got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Request payload length %d not right", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+//BEP 10扩展消息，第一个字节是扩展消息的编号，0表示扩展握手
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected extended but got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Extended message too short")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
 		return 0, fmt.Errorf("Error")
@@ -64,6 +121,19 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+//不检查piece编号，直接取出piece消息里的编号、偏移和数据
+func ParseBlock(msg *Message) (index, begin int, data []byte, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("Expected piece but got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Piece payload length %d too short", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("Error")
@@ -99,14 +169,19 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MaxLength {
+		return nil, fmt.Errorf("Message length %d too long", length)
+	}
 
 	res, err := MessageSerialize(r,int(length))
 
-	return res, nil
+	return res, err
 }
 
 func MessageSerialize(r io.Reader,len int)(*Message, error){
-	
+	if len <= 0 || len > MaxLength {
+		return nil, fmt.Errorf("Message length %d not right", len)
+	}
 	messageBuf := make([]byte, len)
 	_, err := io.ReadFull(r, messageBuf)
 	if err != nil {
@@ -146,6 +221,8 @@ func (m *Message) name() string {
 			return "Piece"
 		case MsgCancel:
 			return "Cancel"
+		case MsgExtended:
+			return "Extended"
 		default:
 			return fmt.Sprintf("Unknown# ID %d", m.ID)
 	}
@@ -0,0 +1,21 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTooLong(t *testing.T) {
+	//长度超过MaxLength的消息在分配内存之前就被拒绝
+	_, err := Read(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.NotNil(t, err)
+
+	msg, err := Read(bytes.NewReader(FormatHave(7).Serialize()))
+	require.Nil(t, err)
+	index, err := ParseHave(msg)
+	require.Nil(t, err)
+	assert.Equal(t, 7, index)
+}
@@ -0,0 +1,144 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/bingnoi/bittorrent/client"
+)
+
+//按速率选出来unchoke的peer个数，另外还有一个optimistic unchoke
+const UnchokeSlots = 3
+
+//重新选择unchoke的间隔，每三轮换一次optimistic unchoke
+const (
+	chokeInterval   = 10 * time.Second
+	optimisticEvery = 3
+)
+
+//第一个连接建立时启动choke算法，所有连接都断开后退出，调用时要持有torr.mu
+func (torr *Torrent) startChoker() {
+	if torr.chokerRunning {
+		return
+	}
+	torr.chokerRunning = true
+	go torr.chokeLoop()
+}
+
+func (torr *Torrent) chokeLoop() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	torr.mu.Lock()
+	closed := torr.closedChan()
+	torr.mu.Unlock()
+
+	for round := 0; ; round++ {
+		torr.mu.Lock()
+		if len(torr.clients) == 0 {
+			torr.chokerRunning = false
+			torr.optimistic = nil
+			torr.mu.Unlock()
+			return
+		}
+		torr.mu.Unlock()
+
+		torr.rechoke(round%optimisticEvery == 0)
+		select {
+		case <-ticker.C:
+		case <-closed:
+			torr.mu.Lock()
+			torr.chokerRunning = false
+			torr.optimistic = nil
+			torr.mu.Unlock()
+			return
+		}
+	}
+}
+
+//tit-for-tat：下载时unchoke给我们速度最快的peer，做种时unchoke我们上传最快的peer
+func (torr *Torrent) rechoke(rotate bool) {
+	torr.mu.Lock()
+	var interested []*client.Client
+	var others []*client.Client
+	for c := range torr.clients {
+		if c.PeerInterested() {
+			interested = append(interested, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	if _, ok := torr.clients[torr.optimistic]; !ok {
+		torr.optimistic = nil
+	}
+	optimistic := torr.optimistic
+	//跳过了文件时Complete永远不成立，按是否在做种判断
+	seeding := torr.seeding
+	torr.mu.Unlock()
+
+	rates := make(map[*client.Client]float64)
+	for _, c := range interested {
+		if seeding {
+			rates[c] = c.UploadRate()
+		} else {
+			rates[c] = c.DownloadRate()
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoke := make(map[*client.Client]bool)
+	for i := 0; i < len(interested) && i < UnchokeSlots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	//optimistic unchoke从剩下的peer里随机挑一个，让新的peer有机会证明自己
+	if rotate || optimistic == nil || unchoke[optimistic] {
+		optimistic = nil
+		var candidates []*client.Client
+		for _, c := range interested {
+			if !unchoke[c] {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(candidates) > 0 {
+			optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	torr.mu.Lock()
+	torr.optimistic = optimistic
+	torr.mu.Unlock()
+
+	for _, c := range append(interested, others...) {
+		if unchoke[c] && c.AmChoking() {
+			c.SendUnchoke()
+		} else if !unchoke[c] && !c.AmChoking() {
+			c.SendChoke()
+		}
+	}
+}
+
+//对方刚变得感兴趣时，如果还有空位就不用等下一轮
+func (torr *Torrent) peerInterested(c *client.Client) {
+	if !c.AmChoking() {
+		return
+	}
+
+	torr.mu.Lock()
+	unchoked := 0
+	for other := range torr.clients {
+		if other != c && other != torr.optimistic && !other.AmChoking() {
+			unchoked++
+		}
+	}
+	torr.mu.Unlock()
+
+	if unchoked < UnchokeSlots {
+		c.SendUnchoke()
+	}
+}
@@ -0,0 +1,47 @@
+package p2p
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/bingnoi/bittorrent/client"
+	"github.com/stretchr/testify/assert"
+)
+
+//一个感兴趣并且被choke的peer，对方读走我们发的所有消息
+func newChokedClient(t *testing.T) *client.Client {
+	conn, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+	c := &client.Client{Conn: conn}
+	c.SetPeerInterested(true)
+	c.SendChoke()
+	return c
+}
+
+func TestRechokeSeeding(t *testing.T) {
+	//跳过了piece 1，下载完之后也不是Complete
+	torr := &Torrent{
+		PieceHashes: make([][20]byte, 2),
+		Bitfield:    newBitfield(2, 0),
+		Priorities:  []Priority{PriorityNormal, PrioritySkip},
+		seeding:     true,
+		clients:     make(map[*client.Client]bool),
+	}
+	var conns []*client.Client
+	for i := 0; i < UnchokeSlots+2; i++ {
+		c := newChokedClient(t)
+		defer c.Conn.Close()
+		//下载速率都是0，只有上传速率不同
+		c.AddUploaded((i + 1) * 1000)
+		torr.clients[c] = true
+		conns = append(conns, c)
+	}
+
+	//做种时按上传速率选出最快的几个
+	torr.rechoke(false)
+	for i := len(conns) - UnchokeSlots; i < len(conns); i++ {
+		assert.False(t, conns[i].AmChoking(), "peer #%d", i)
+	}
+}
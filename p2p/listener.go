@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bingnoi/bittorrent/client"
+)
+
+//监听announce给tracker的端口，按照握手里的info hash把连接交给对应的Torrent
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		ln:       ln,
+		torrents: make(map[[20]byte]*Torrent),
+	}
+	go l.serve()
+	log.Println("Listening on", ln.Addr())
+	return l, nil
+}
+
+func (l *Listener) Register(torr *Torrent) {
+	l.mu.Lock()
+	l.torrents[torr.InfoHash] = torr
+	l.mu.Unlock()
+}
+
+func (l *Listener) Unregister(torr *Torrent) {
+	l.mu.Lock()
+	delete(l.torrents, torr.InfoHash)
+	l.mu.Unlock()
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			//监听已经关闭
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+//读取对方的握手，找不到对应torrent的连接直接关闭
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	res, err := client.ConnectionRead(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	torr, ok := l.torrents[res.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		log.Printf("Incoming peer %s asked for unknown torrent %x\n", conn.RemoteAddr(), res.InfoHash)
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, res, torr.PeerID)
+	if err != nil {
+		log.Printf("Incoming peer %s .... HandShake Fail\n", conn.RemoteAddr())
+		return
+	}
+	torr.AddConn(c)
+}
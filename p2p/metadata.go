@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/bingnoi/bittorrent/client"
+	"github.com/bingnoi/bittorrent/message"
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+//BEP 9规定metadata按16KiB分块传输
+const metadataPieceSize = 16384
+
+//info字典的大小上限，防止对方声明一个超大的值
+const maxMetadataSize = 16 * 1024 * 1024
+
+//ut_metadata的消息类型
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+type metadataResult struct {
+	buf []byte
+	err error
+}
+
+//同时向所有peer请求info字典，第一个通过哈希校验的结果胜出，之后断开其他连接
+func FetchMetadata(peerList []peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	log.Printf("Fetching metadata of %x from %d peers\n", infoHash, len(peerList))
+
+	done := make(chan struct{})
+	defer close(done)
+	results := make(chan metadataResult, len(peerList))
+	for _, peer := range peerList {
+		go func(peer peers.Peer) {
+			buf, err := fetchMetadataFrom(peer, peerID, infoHash, done)
+			results <- metadataResult{buf, err}
+		}(peer)
+	}
+
+	for range peerList {
+		res := <-results
+		if res.err == nil {
+			log.Println("Metadata...OK")
+			return res.buf, nil
+		}
+		log.Println("Metadata fail:", res.err)
+	}
+	return nil, fmt.Errorf("No peer could provide metadata of %x", infoHash)
+}
+
+//done关闭时说明已经拿到metadata，直接断开连接
+func fetchMetadataFrom(peer peers.Peer, peerID, infoHash [20]byte, done <-chan struct{}) ([]byte, error) {
+	c, err := client.New(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			c.Conn.Close()
+		case <-finished:
+		}
+	}()
+
+	if !c.Extensions {
+		return nil, fmt.Errorf("Peer %s does not support extensions", peer)
+	}
+	err = c.SendExtHandshake(0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	//等待对方的扩展握手，拿到metadata大小
+	for {
+		_, ok := c.ExtensionID("ut_metadata")
+		if ok && c.MetadataSize > 0 {
+			break
+		}
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil && msg.ID == message.MsgExtended {
+			err = c.HandleExtended(msg)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	size := c.MetadataSize
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("Peer %s metadata size %d too large", peer, size)
+	}
+
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for i := 0; i < numPieces; i++ {
+		err = sendMetadataMsg(c, metadataMsg{MsgType: metadataRequest, Piece: i}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, size)
+	received := make([]bool, numPieces)
+	left := numPieces
+	for left > 0 {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+
+		extID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if extID != client.LocalExtensions["ut_metadata"] {
+			continue
+		}
+
+		hdr, data, err := parseMetadataMsg(payload)
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("Peer %s rejected metadata piece %d", peer, hdr.Piece)
+		case metadataData:
+			if hdr.Piece < 0 || hdr.Piece >= numPieces || received[hdr.Piece] {
+				continue
+			}
+			begin := hdr.Piece * metadataPieceSize
+			if begin+len(data) > size {
+				return nil, fmt.Errorf("Peer %s sent too much metadata", peer)
+			}
+			copy(buf[begin:], data)
+			received[hdr.Piece] = true
+			left--
+		}
+	}
+
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Peer %s sent metadata with wrong hash %x", peer, hash)
+	}
+	return buf, nil
+}
+
+//ut_metadata消息是一个bencode字典，data消息后面紧跟着原始数据
+func parseMetadataMsg(payload []byte) (metadataMsg, []byte, error) {
+	hdr := metadataMsg{}
+	r := bufio.NewReader(bytes.NewReader(payload))
+	err := bencode.Unmarshal(r, &hdr)
+	if err != nil {
+		return hdr, nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	return hdr, data, err
+}
+
+func sendMetadataMsg(c *client.Client, hdr metadataMsg, data []byte) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, hdr)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return c.SendExtended("ut_metadata", buf.Bytes())
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/bingnoi/bittorrent/client"
+	"github.com/bingnoi/bittorrent/message"
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//对方给ut_metadata分配的编号
+const peerMetadataID = 3
+
+//只会回复ut_metadata的peer，声明的大小是len(metadata)，所有请求到齐后倒序发回
+func startMetadataPeer(t *testing.T, infoHash [20]byte, metadata []byte) (peers.Peer, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveMetadata(conn, infoHash, metadata)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, func() { ln.Close() }
+}
+
+func serveMetadata(conn net.Conn, infoHash [20]byte, metadata []byte) {
+	defer conn.Close()
+	_, err := client.ConnectionRead(conn)
+	if err != nil {
+		return
+	}
+	conn.Write(client.NewHandShake(infoHash, [20]byte{9}).Serialize())
+
+	numPieces := (len(metadata) + metadataPieceSize - 1) / metadataPieceSize
+	var requests []int
+	for len(requests) < numPieces {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		extID, payload, _ := message.ParseExtended(msg)
+		switch extID {
+		case client.ExtHandshakeID:
+			var buf bytes.Buffer
+			bencode.Marshal(&buf, struct {
+				M            map[string]int `bencode:"m"`
+				MetadataSize int            `bencode:"metadata_size"`
+			}{map[string]int{"ut_metadata": peerMetadataID}, len(metadata)})
+			conn.Write(message.FormatExtended(client.ExtHandshakeID, buf.Bytes()).Serialize())
+		case peerMetadataID:
+			hdr, _, err := parseMetadataMsg(payload)
+			if err == nil && hdr.MsgType == metadataRequest {
+				requests = append(requests, hdr.Piece)
+			}
+		}
+	}
+
+	for i := len(requests) - 1; i >= 0; i-- {
+		begin := requests[i] * metadataPieceSize
+		end := begin + metadataPieceSize
+		if end > len(metadata) {
+			end = len(metadata)
+		}
+		var buf bytes.Buffer
+		bencode.Marshal(&buf, metadataMsg{MsgType: metadataData, Piece: requests[i], TotalSize: len(metadata)})
+		buf.Write(metadata[begin:end])
+		conn.Write(message.FormatExtended(client.LocalExtensions["ut_metadata"], buf.Bytes()).Serialize())
+	}
+	//等对方断开
+	message.Read(conn)
+}
+
+func TestFetchMetadata(t *testing.T) {
+	//跨两个metadata块，最后一块不满
+	metadata := make([]byte, metadataPieceSize+5000)
+	rand.Read(metadata)
+	infoHash := sha1.Sum(metadata)
+
+	peer, stop := startMetadataPeer(t, infoHash, metadata)
+	defer stop()
+
+	buf, err := fetchMetadataFrom(peer, [20]byte{1}, infoHash, make(chan struct{}))
+	require.Nil(t, err)
+	assert.Equal(t, metadata, buf)
+}
+
+func TestFetchMetadataBadHash(t *testing.T) {
+	metadata := make([]byte, metadataPieceSize+5000)
+	rand.Read(metadata)
+	infoHash := sha1.Sum(metadata)
+	corrupt := append([]byte(nil), metadata...)
+	corrupt[100] ^= 0xff
+
+	bad, stopBad := startMetadataPeer(t, infoHash, corrupt)
+	defer stopBad()
+	_, err := fetchMetadataFrom(bad, [20]byte{1}, infoHash, make(chan struct{}))
+	assert.NotNil(t, err)
+
+	//哈希不对的peer被跳过，用其他peer给的
+	good, stopGood := startMetadataPeer(t, infoHash, metadata)
+	defer stopGood()
+	buf, err := FetchMetadata([]peers.Peer{bad, good}, [20]byte{1}, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, metadata, buf)
+}
@@ -3,20 +3,31 @@ package p2p
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bingnoi/bittorrent/bitfield"
 	"github.com/bingnoi/bittorrent/client"
 	"github.com/bingnoi/bittorrent/message"
 	"github.com/bingnoi/bittorrent/peers"
+	"github.com/bingnoi/bittorrent/storage"
 )
 
 const MaxBlockSize = 16384
 
 const MaxBacklog = 5
 
+//多长时间没有收到对方任何消息就断开，对方至少每两分钟会发keep-alive
+const peerIdleTimeout = 3 * time.Minute
+
+//调用了Interrupt，下载没有完成
+var ErrInterrupted = errors.New("Download interrupted")
+
 type Torrent struct {
 	Peers       []peers.Peer
 	PeerID      [20]byte
@@ -25,6 +36,39 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Storage     storage.Storage
+	Bitfield    bitfield.Bitfield
+	Downloaded  int64
+	Uploaded    int64
+	//顺序下载，适合边下边播
+	Sequential bool
+	//每个piece的优先级，nil表示全部下载
+	Priorities []Priority
+
+	mu sync.Mutex
+	//下载过程中的picker，以及已经在连接的peer，用来接收tracker新给的peer
+	picker  *picker
+	results chan *pieceResult
+	//Download返回时关闭，之后不再有人读results
+	done   chan struct{}
+	active map[string]bool
+	//已经完成握手的连接，下载到新的piece后给它们发have
+	clients map[*client.Client]bool
+	//下载完成后是否还在做种
+	seeding bool
+	//choke算法的状态
+	chokerRunning bool
+	optimistic    *client.Client
+	//正在读取的Reader和它们所在的piece，有新piece时通过cond唤醒
+	readers map[*Reader]int
+	cond    *sync.Cond
+	stopped bool
+	//Interrupt时关闭
+	interrupt chan struct{}
+	//Close时关闭，之后不再接收新的连接
+	closed chan struct{}
+	//连接peer的协程，Close时等它们全部退出
+	workers sync.WaitGroup
 }
 
 type filePiece struct {
@@ -38,83 +82,120 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+//向peer请求的一个block
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
-	}
+//一个连接上的下载状态，block由picker分配，同一个piece的block可以来自不同的peer
+type peerDownload struct {
+	torr    *Torrent
+	client  *client.Client
+	pk      *picker
+	results chan *pieceResult
+	done    chan struct{}
+	//已经发出去还没收到的request和发出的时间
+	inflight map[blockRequest]time.Time
+	//这个连接上超时过的block，picker先交给其他peer
+	timedOut map[blockRequest]bool
+}
 
-	if msg == nil {
-		return nil
-	}
+//请求发出后多久没收到就交给其他peer
+const blockTimeout = 30 * time.Second
 
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
+//把backlog填满
+func (dl *peerDownload) fill() error {
+	for len(dl.inflight) < MaxBacklog {
+		req, ok := dl.pk.nextBlock(dl.client.Bitfield, dl.inflight, dl.timedOut)
+		if !ok {
+			return nil
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		err := dl.client.SendRequest(req.index, req.begin, req.length)
 		if err != nil {
+			dl.pk.unrequest(req)
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		dl.inflight[req] = time.Now()
+		delete(dl.timedOut, req)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *filePiece) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+//endgame里其他peer已经给过的block发cancel，超时的block交给其他peer
+func (dl *peerDownload) cancelStale() {
+	for req, sent := range dl.inflight {
+		got := dl.pk.received(req)
+		if !got && time.Since(sent) <= blockTimeout {
+			continue
+		}
+		dl.client.SendCancel(req.index, req.begin, req.length)
+		dl.pk.unrequest(req)
+		delete(dl.inflight, req)
+		//超时的block记下来，不要马上又分给这个连接
+		if !got {
+			dl.timedOut[req] = true
+		}
+	}
+	for req := range dl.timedOut {
+		if dl.pk.received(req) {
+			delete(dl.timedOut, req)
+		}
 	}
+}
 
-	//设置最大超时时长
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+//断开或者被choke时，对方不会再回复之前的request
+func (dl *peerDownload) releaseAll() {
+	for req := range dl.inflight {
+		dl.pk.unrequest(req)
+		delete(dl.inflight, req)
+	}
+}
 
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
+//收到一个block，piece凑齐之后校验并交给Download写盘
+func (dl *peerDownload) onBlock(msg *message.Message) error {
+	index, begin, data, err := message.ParseBlock(msg)
+	if err != nil {
+		return err
+	}
+	dl.client.AddDownloaded(len(data))
 
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+	req := blockRequest{index, begin, len(data)}
+	_, requested := dl.inflight[req]
+	delete(dl.inflight, req)
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
+	buf, complete := dl.pk.receive(index, begin, data, requested)
+	if !complete {
+		return nil
+	}
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+	pw := dl.torr.pieceWork(index)
+	err = checkIntegrity(pw, buf)
+	if err != nil {
+		log.Printf("Piece #%d not right, Check please\n", index)
+		dl.pk.reset(index)
+		return nil
+	}
+
+	//endgame里同一个piece可能已经交过，只交一次；Download已经返回时没有人接收，直接丢掉
+	if dl.pk.finish(index) {
+		select {
+		case dl.results <- &pieceResult{index, buf}:
+		case <-dl.done:
 		}
 	}
+	return nil
+}
 
-	return state.buf, nil
+//Download已经返回，出错或者被中断
+func (dl *peerDownload) stopped() bool {
+	select {
+	case <-dl.done:
+		return true
+	default:
+		return false
+	}
 }
 
 //通过哈希算法检查完整性
@@ -126,9 +207,16 @@ func checkIntegrity(pw *filePiece, buf []byte) error {
 	return nil
 }
 
+//给外部使用的校验入口，和下载时的校验完全一样
+func CheckPiece(index int, hash [20]byte, buf []byte) error {
+	return checkIntegrity(&filePiece{index, hash, len(buf)}, buf)
+}
 
 //这个地方是为了实现下载pieces，分为1、建立handshake，发送unchoke 2、获取pieces
-func (torr *Torrent) startDownloadWorker(peer peers.Peer, downloadQueue chan *filePiece, results chan *pieceResult) {
+func (torr *Torrent) startDownloadWorker(peer peers.Peer, pk *picker, results chan *pieceResult, done chan struct{}) {
+
+	defer torr.workers.Done()
+	defer torr.removeActive(peer)
 
 	//1、新建client，进行handshake
 	c, err := client.New(peer, torr.PeerID, torr.InfoHash)
@@ -136,46 +224,143 @@ func (torr *Torrent) startDownloadWorker(peer peers.Peer, downloadQueue chan *fi
 		log.Printf("Connecting with %s .... HandShake Fail\n", peer.IP)
 		return
 	}
-	defer c.Conn.Close()
 	log.Printf("Connecting with %s .... HandShake OK\n", peer.IP)
 
-	//发送相关信息
-	c.SendUnchoke()
-	c.SendInterested()
+	torr.runPeer(c, pk, results, done)
+}
+
+//握手之后的流程，主动连接和对方连进来的peer都走这里，下载结束后只负责上传
+func (torr *Torrent) runPeer(c *client.Client, pk *picker, results chan *pieceResult, done chan struct{}) {
+	defer c.Conn.Close()
+	if !torr.addClient(c) {
+		return
+	}
+	defer torr.removeClient(c)
+
+	//对方可能没有发bitfield，或者长度不对
+	bf := bitfield.New(len(torr.PieceHashes))
+	copy(bf, c.Bitfield)
+	c.Bitfield = bf
+	defer func() {
+		if current := torr.currentPicker(); current != nil {
+			current.removePeer(c.Bitfield)
+		}
+	}()
 
+	//发送相关信息，是否unchoke对方由choke算法决定
+	c.SendBitfield(torr.bitfieldSnapshot())
 
-	//开启下载队列
-	for pw := range downloadQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			downloadQueue <- pw
-			continue
+	cache := &pieceCache{}
+	var dl *peerDownload
+	if pk != nil {
+		dl = &peerDownload{torr, c, pk, results, done, make(map[blockRequest]time.Time), make(map[blockRequest]bool)}
+		defer dl.releaseAll()
+	}
+
+	idle := time.Duration(0)
+	amInterested := false
+	for {
+		if dl != nil && (dl.pk.finished() || dl.stopped()) {
+			dl.releaseAll()
+			dl = nil
+		}
+
+		//只有对方有我们缺少的piece时才感兴趣
+		want := dl != nil && dl.pk.interesting(c.Bitfield)
+		if want != amInterested {
+			if want {
+				c.SendInterested()
+			} else {
+				c.SendNotInterested()
+			}
+			amInterested = want
+		}
+
+		//对方unchoke了我们就一直保持MaxBacklog个block在路上
+		if dl != nil {
+			dl.cancelStale()
+			if !c.Choked {
+				err := dl.fill()
+				if err != nil {
+					log.Println("Bye", err)
+					return
+				}
+			}
+		} else if torr.peerDone(c) {
+			//双方都已经是完整的，没有必要再保持连接
+			return
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		ok, err := c.Wait(time.Second)
 		if err != nil {
 			log.Println("Bye", err)
-			downloadQueue <- pw
 			return
 		}
+		if !ok {
+			idle += time.Second
+			if idle >= peerIdleTimeout {
+				log.Printf("Peer %s idle too long, Bye\n", c.Peer().IP)
+				return
+			}
+			continue
+		}
+		idle = 0
 
-		err = checkIntegrity(pw, buf)
+		c.Conn.SetReadDeadline(time.Now().Add(blockTimeout))
+		msg, err := c.Read()
+		c.Conn.SetReadDeadline(time.Time{})
 		if err != nil {
-			log.Printf("Piece #%d not right, Check please\n", pw.index)
-			downloadQueue <- pw
-			continue
+			log.Println("Bye", err)
+			return
+		}
+		if msg != nil && msg.ID == message.MsgPiece {
+			if dl != nil {
+				err = dl.onBlock(msg)
+			}
+		} else if msg != nil {
+			err = torr.handleMessage(c, msg)
+			//被choke之后对方会丢掉所有request
+			if dl != nil && c.Choked {
+				dl.releaseAll()
+			}
+		}
+		if err != nil {
+			log.Println("Bye", err)
+			return
 		}
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		//下载的同时也回复对方的request
+		if !c.Pending() {
+			err = torr.serveRequests(c, cache)
+			if err != nil {
+				log.Println("Bye", err)
+				return
+			}
+		}
+	}
+}
+
+//我们和对方都有全部piece
+func (torr *Torrent) peerDone(c *client.Client) bool {
+	for index := range torr.PieceHashes {
+		if !c.Bitfield.HasPiece(index) || !torr.hasPiece(index) {
+			return false
+		}
 	}
+	return true
 }
 
 //计算边界，用于处理完整性的
 func (torr *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
-	begin = index * torr.PieceLength
-	end = begin + torr.PieceLength
-	if end > torr.Length {
-		end = torr.Length
+	return PieceBounds(index, torr.PieceLength, torr.Length)
+}
+
+//piece在整个payload中的起止位置，最后一个piece可能比较短
+func PieceBounds(index, pieceLength, length int) (begin int, end int) {
+	begin = index * pieceLength
+	end = begin + pieceLength
+	if end > length {
+		end = length
 	}
 	return begin, end
 }
@@ -185,38 +370,194 @@ func (torr *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-//下载pieces
-func (torr *Torrent) Download() ([]byte, error) {
+func (torr *Torrent) pieceWork(index int) *filePiece {
+	return &filePiece{index, torr.PieceHashes[index], torr.calculatePieceSize(index)}
+}
+
+//下载pieces，每个校验通过的piece直接写到Storage里
+func (torr *Torrent) Download() error {
 	log.Println("Now, We are downloading file : ", torr.Name)
 
-	//生成队列
-	downloadQueue := make(chan *filePiece, len(torr.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range torr.PieceHashes {
-		length := torr.calculatePieceSize(index)
-		downloadQueue <- &filePiece{index, hash, length}
+	torr.mu.Lock()
+	if torr.Bitfield == nil {
+		torr.Bitfield = bitfield.New(len(torr.PieceHashes))
 	}
+	torr.mu.Unlock()
+
+	//已经有的piece不再下载，其余的由picker按稀有程度分给各个peer
+	pk := newPicker(len(torr.PieceHashes), torr.PieceLength, torr.Length, torr.Bitfield, torr.Priorities)
+	pk.sequential = torr.Sequential
+	results := make(chan *pieceResult)
+	done := make(chan struct{})
+	defer close(done)
+	//跳过的piece也算在完成里
+	donePieces := len(torr.PieceHashes) - pk.left
 
 	//生成peers对象,并下载
-	for _, peer := range torr.Peers {
-		go torr.startDownloadWorker(peer, downloadQueue, results)
+	torr.mu.Lock()
+	torr.picker = pk
+	torr.results = results
+	torr.done = done
+	torr.stopped = false
+	if torr.active == nil {
+		torr.active = make(map[string]bool)
 	}
-
-	buf := make([]byte, torr.Length)
-	donePieces := 0
+	peerList := torr.Peers
+	torr.Peers = nil
+	interrupt := torr.interruptChan()
+	torr.mu.Unlock()
+	torr.updateUrgent()
+	torr.AddPeers(peerList)
 
 	//对于每个piece
 	for donePieces < len(torr.PieceHashes) {
-		res := <-results
-		begin, end := torr.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case res = <-results:
+		case <-interrupt:
+			torr.stopDownload()
+			return ErrInterrupted
+		}
+		err := torr.Storage.WritePiece(res.index, res.buf)
+		if err != nil {
+			torr.stopDownload()
+			return err
+		}
+		torr.mu.Lock()
+		torr.Bitfield.SetPiece(res.index)
+		torr.wakeReaders()
+		torr.mu.Unlock()
+		torr.broadcastHave(res.index)
+		atomic.AddInt64(&torr.Downloaded, int64(len(res.buf)))
 		donePieces++
 
 		percent := float64(donePieces) / float64(len(torr.PieceHashes)) * 100
 		numWorkers := runtime.NumGoroutine() - 1
 		log.Printf("(We have gone through (%0.2f%%)), #%d --(piece)--> #%d", percent, numWorkers, res.index)
 	}
-	close(downloadQueue)
+	torr.stopDownload()
+
+	return nil
+}
+
+//加入新的peer，下载和做种过程中会立刻开始连接，已经在连接的peer不会重复连接
+func (torr *Torrent) AddPeers(peerList []peers.Peer) {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+
+	known := make(map[string]bool)
+	for _, peer := range torr.Peers {
+		known[peer.String()] = true
+	}
+	for _, peer := range peerList {
+		if !known[peer.String()] {
+			known[peer.String()] = true
+			torr.Peers = append(torr.Peers, peer)
+		}
+
+		if (torr.picker == nil && !torr.seeding) || torr.active[peer.String()] {
+			continue
+		}
+		torr.active[peer.String()] = true
+		torr.workers.Add(1)
+		go torr.startDownloadWorker(peer, torr.picker, torr.results, torr.done)
+	}
+}
+
+//对方主动连进来的peer，握手已经完成，交给和主动连接相同的流程处理；做种时只给对方上传，既不下载也不做种时拒绝
+func (torr *Torrent) AddConn(c *client.Client) {
+	peer := c.Peer()
+
+	torr.mu.Lock()
+	if torr.active == nil {
+		torr.active = make(map[string]bool)
+	}
+	if (torr.picker == nil && !torr.seeding) || torr.active[peer.String()] {
+		torr.mu.Unlock()
+		c.Conn.Close()
+		return
+	}
+	torr.active[peer.String()] = true
+	torr.workers.Add(1)
+	pk, results, done := torr.picker, torr.results, torr.done
+	torr.mu.Unlock()
+
+	log.Printf("Incoming peer %s .... HandShake OK\n", peer.IP)
+	go func() {
+		defer torr.workers.Done()
+		defer torr.removeActive(peer)
+		torr.runPeer(c, pk, results, done)
+	}()
+}
+
+//连接断开后允许tracker再次给出这个peer时重新连接
+func (torr *Torrent) removeActive(peer peers.Peer) {
+	torr.mu.Lock()
+	delete(torr.active, peer.String())
+	torr.mu.Unlock()
+}
+
+//中断下载，Download尽快返回ErrInterrupted，在Download开始之前调用也有效
+func (torr *Torrent) Interrupt() {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	interrupt := torr.interruptChan()
+	select {
+	case <-interrupt:
+	default:
+		close(interrupt)
+	}
+}
+
+//停止下载和做种，断开所有连接并等连接的协程退出，之后才能关闭Storage
+func (torr *Torrent) Close() {
+	torr.mu.Lock()
+	closed := torr.closedChan()
+	select {
+	case <-closed:
+	default:
+		close(closed)
+	}
+	torr.picker = nil
+	torr.seeding = false
+	torr.stopped = true
+	torr.wakeReaders()
+	for c := range torr.clients {
+		c.Conn.Close()
+	}
+	torr.mu.Unlock()
+
+	torr.workers.Wait()
+}
+
+//调用时要持有torr.mu
+func (torr *Torrent) closedChan() chan struct{} {
+	if torr.closed == nil {
+		torr.closed = make(chan struct{})
+	}
+	return torr.closed
+}
+
+//调用时要持有torr.mu
+func (torr *Torrent) interruptChan() chan struct{} {
+	if torr.interrupt == nil {
+		torr.interrupt = make(chan struct{})
+	}
+	return torr.interrupt
+}
+
+//下载结束，不再接收新的peer
+func (torr *Torrent) stopDownload() {
+	torr.mu.Lock()
+	torr.picker = nil
+	torr.stopped = true
+	torr.wakeReaders()
+	torr.mu.Unlock()
+}
 
-	return buf, nil
+//正在下载时的picker，没有在下载时为nil
+func (torr *Torrent) currentPicker() *picker {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	return torr.picker
 }
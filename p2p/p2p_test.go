@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/client"
+	"github.com/bingnoi/bittorrent/message"
+	"github.com/bingnoi/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelStale(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	defer remote.Close()
+
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	dl := &peerDownload{
+		client:   &client.Client{Conn: conn, Bitfield: all},
+		pk:       p,
+		inflight: make(map[blockRequest]time.Time),
+	}
+
+	req, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	dl.inflight[req] = time.Now()
+
+	//endgame里另一个peer先给了这个block
+	p.receive(req.index, req.begin, make([]byte, req.length), true)
+
+	msgs := make(chan *message.Message, 1)
+	go func() {
+		msg, err := message.Read(remote)
+		if err == nil {
+			msgs <- msg
+		}
+	}()
+	dl.cancelStale()
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, message.MsgCancel, msg.ID)
+		index, begin, length, err := message.ParseRequest(msg)
+		require.Nil(t, err)
+		assert.Equal(t, req, blockRequest{index, begin, length})
+	case <-time.After(time.Second):
+		t.Fatal("no cancel sent")
+	}
+	assert.Empty(t, dl.inflight)
+}
+
+func TestOnBlockAfterDownloadStopped(t *testing.T) {
+	data := make([]byte, testPieceLength)
+	rand.Read(data)
+	torr := &Torrent{PieceHashes: [][20]byte{sha1.Sum(data)}, PieceLength: testPieceLength, Length: testPieceLength}
+
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	first, _ := p.nextBlock(all, nil, nil)
+	second, _ := p.nextBlock(all, nil, nil)
+	p.receive(0, first.begin, data[first.begin:first.begin+first.length], true)
+
+	//Download已经返回，没有人再读results
+	done := make(chan struct{})
+	close(done)
+	dl := &peerDownload{
+		torr:     torr,
+		client:   &client.Client{Bitfield: all},
+		pk:       p,
+		results:  make(chan *pieceResult),
+		done:     done,
+		inflight: map[blockRequest]time.Time{second: time.Now()},
+	}
+	assert.True(t, dl.stopped())
+
+	returned := make(chan error, 1)
+	go func() {
+		returned <- dl.onBlock(message.FormatPiece(0, second.begin, data[second.begin:]))
+	}()
+	select {
+	case err := <-returned:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("onBlock blocked on results")
+	}
+}
+
+func TestClose(t *testing.T) {
+	torr := &Torrent{
+		PieceHashes: [][20]byte{{}},
+		PieceLength: testPieceLength,
+		Length:      testPieceLength,
+		Storage:     storage.NewMemoryStorage(testPieceLength, testPieceLength),
+		seeding:     true,
+	}
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	//对方发起握手，之后一直读到连接被关闭
+	closed := make(chan struct{})
+	go func() {
+		remote.Write(client.NewHandShake([20]byte{}, [20]byte{1}).Serialize())
+		client.ConnectionRead(remote)
+		for {
+			_, err := message.Read(remote)
+			if err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	res, err := client.ConnectionRead(conn)
+	require.Nil(t, err)
+	c, err := client.Accept(conn, res, [20]byte{2})
+	require.Nil(t, err)
+	torr.AddConn(c)
+
+	returned := make(chan struct{})
+	go func() {
+		torr.Close()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wait for peers to exit")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	//Close之后不再接收新的连接
+	torr.mu.Lock()
+	assert.Empty(t, torr.clients)
+	torr.mu.Unlock()
+	other, _ := net.Pipe()
+	assert.False(t, torr.addClient(&client.Client{Conn: other}))
+}
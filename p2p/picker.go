@@ -0,0 +1,365 @@
+package p2p
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+)
+
+//piece的下载优先级，零值是普通优先级
+type Priority int
+
+const (
+	PrioritySkip Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+//Reader当前位置附近的piece比所有优先级都高
+const priorityUrgent = PriorityHigh + 1
+
+//决定下一个从哪个peer下载哪个block，优先把已经开始的piece下完，新的piece挑拥有的peer最少的
+type picker struct {
+	mu sync.Mutex
+	//每个piece有多少个连接着的peer拥有
+	availability []int
+	have         bitfield.Bitfield
+	//正在下载的piece，不同的block可以来自不同的peer
+	partial     map[int]*partialPiece
+	pieceLength int
+	length      int
+	left        int
+	endgame     bool
+	//顺序下载模式，新的piece按编号从小到大下载
+	sequential bool
+	//Reader当前位置附近的piece，最先下载
+	urgent []bool
+	//每个piece的优先级，跳过的piece不下载
+	priority []Priority
+}
+
+//一个正在下载的piece，requested是每个block已经发出去还没回来的request个数
+type partialPiece struct {
+	buf       []byte
+	requested []int
+	received  []bool
+	left      int
+}
+
+//priorities为nil时所有piece都是普通优先级
+func newPicker(numPieces, pieceLength, length int, have bitfield.Bitfield, priorities []Priority) *picker {
+	p := &picker{
+		availability: make([]int, numPieces),
+		have:         bitfield.New(numPieces),
+		partial:      make(map[int]*partialPiece),
+		urgent:       make([]bool, numPieces),
+		priority:     make([]Priority, numPieces),
+		pieceLength:  pieceLength,
+		length:       length,
+	}
+	copy(p.have, have)
+	copy(p.priority, priorities)
+	for index := 0; index < numPieces; index++ {
+		if !p.have.HasPiece(index) && p.priority[index] != PrioritySkip {
+			p.left++
+		}
+	}
+	return p
+}
+
+//peer连接或者发来bitfield时加上它拥有的piece，断开时减掉
+func (p *picker) addPeer(bf bitfield.Bitfield) {
+	p.updatePeer(bf, 1)
+}
+
+func (p *picker) removePeer(bf bitfield.Bitfield) {
+	p.updatePeer(bf, -1)
+}
+
+func (p *picker) updatePeer(bf bitfield.Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index] += delta
+		}
+	}
+}
+
+//peer发来have
+func (p *picker) peerHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+//对方有没有我们还需要的piece
+func (p *picker) interesting(bf bitfield.Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if p.wanted(index) && bf.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+//piece当前的优先级，跳过的piece即使Reader在读也不下载
+func (p *picker) level(index int) Priority {
+	if p.priority[index] == PrioritySkip {
+		return PrioritySkip
+	}
+	if p.urgent[index] {
+		return priorityUrgent
+	}
+	return p.priority[index]
+}
+
+//还没有下载并且需要下载的piece
+func (p *picker) wanted(index int) bool {
+	return !p.have.HasPiece(index) && p.priority[index] != PrioritySkip
+}
+
+func (p *picker) pieceSize(index int) int {
+	begin := index * p.pieceLength
+	end := begin + p.pieceLength
+	if end > p.length {
+		end = p.length
+	}
+	return end - begin
+}
+
+//给对方分一个block，inflight是这个连接上已经请求过的block，timedOut是这个连接上超时过的block，
+//超时的block先留给其他peer，没有别的可以请求时才再交给这个连接
+func (p *picker) nextBlock(bf bitfield.Bitfield, inflight map[blockRequest]time.Time, timedOut map[blockRequest]bool) (blockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var retry blockRequest
+	var retryPiece *partialPiece
+	//从高到低按优先级挑：Reader正在等的piece，高优先级文件，普通文件，同一级里先把已经开始的piece下完，减少同时在内存里的piece
+	for level := priorityUrgent; level >= PriorityNormal; level-- {
+		for index, pp := range p.partial {
+			if !bf.HasPiece(index) || p.level(index) < level {
+				continue
+			}
+			for block := range pp.received {
+				if pp.received[block] || pp.requested[block] != 0 {
+					continue
+				}
+				req := p.block(index, block)
+				if timedOut[req] {
+					if retryPiece == nil {
+						retry, retryPiece = req, pp
+					}
+					continue
+				}
+				pp.requested[block]++
+				return req, true
+			}
+		}
+
+		index, ok := p.newPiece(bf, level)
+		if !ok {
+			continue
+		}
+		size := p.pieceSize(index)
+		numBlocks := (size + MaxBlockSize - 1) / MaxBlockSize
+		pp := &partialPiece{
+			buf:       make([]byte, size),
+			requested: make([]int, numBlocks),
+			received:  make([]bool, numBlocks),
+			left:      numBlocks,
+		}
+		p.partial[index] = pp
+		pp.requested[0]++
+		return p.block(index, 0), true
+	}
+
+	req, ok := p.endgameBlock(bf, inflight, timedOut)
+	if !ok && retryPiece != nil {
+		retryPiece.requested[retry.begin/MaxBlockSize]++
+		return retry, true
+	}
+	return req, ok
+}
+
+//开始一个新的piece：顺序模式下按编号，否则挑最稀有的，一样稀有时随机挑，避免所有peer都去下载同一个piece
+func (p *picker) newPiece(bf bitfield.Bitfield, level Priority) (int, bool) {
+	wanted := func(index int) bool {
+		return p.level(index) >= level && p.wanted(index) && p.partial[index] == nil && bf.HasPiece(index)
+	}
+
+	//Reader等着的piece也按编号从小到大
+	if p.sequential || level == priorityUrgent {
+		for index := range p.availability {
+			if wanted(index) {
+				return index, true
+			}
+		}
+		return 0, false
+	}
+
+	var candidates []int
+	rarest := 0
+	for index, count := range p.availability {
+		if !wanted(index) {
+			continue
+		}
+		if len(candidates) == 0 || count < rarest {
+			candidates = candidates[:0]
+			rarest = count
+		}
+		if count == rarest {
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+//重新设置优先下载的piece
+func (p *picker) setUrgent(urgent []bool) {
+	p.mu.Lock()
+	copy(p.urgent, urgent)
+	p.mu.Unlock()
+}
+
+//所有block都已经请求过之后进入endgame，还没收到的block也向其他peer请求，谁先到用谁的
+func (p *picker) endgameBlock(bf bitfield.Bitfield, inflight map[blockRequest]time.Time, timedOut map[blockRequest]bool) (blockRequest, bool) {
+	for index := range p.availability {
+		if p.wanted(index) && p.partial[index] == nil {
+			return blockRequest{}, false
+		}
+	}
+	for _, pp := range p.partial {
+		for block := range pp.received {
+			if !pp.received[block] && pp.requested[block] == 0 {
+				return blockRequest{}, false
+			}
+		}
+	}
+
+	var best blockRequest
+	var bestPiece *partialPiece
+	fewest := 0
+	for index, pp := range p.partial {
+		if !bf.HasPiece(index) {
+			continue
+		}
+		for block := range pp.received {
+			req := p.block(index, block)
+			if _, ok := inflight[req]; ok || pp.received[block] || timedOut[req] {
+				continue
+			}
+			if bestPiece == nil || pp.requested[block] < fewest {
+				best, bestPiece, fewest = req, pp, pp.requested[block]
+			}
+		}
+	}
+	if bestPiece == nil {
+		return blockRequest{}, false
+	}
+
+	if !p.endgame {
+		p.endgame = true
+		log.Printf("Endgame, %d pieces left\n", p.left)
+	}
+	bestPiece.requested[best.begin/MaxBlockSize]++
+	return best, true
+}
+
+func (p *picker) block(index, block int) blockRequest {
+	begin := block * MaxBlockSize
+	length := MaxBlockSize
+	if size := p.pieceSize(index); size-begin < length {
+		length = size - begin
+	}
+	return blockRequest{index, begin, length}
+}
+
+//request被取消、超时或者被choke，block交给其他peer
+func (p *picker) unrequest(req blockRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp := p.partial[req.index]
+	if pp != nil && pp.requested[req.begin/MaxBlockSize] > 0 {
+		pp.requested[req.begin/MaxBlockSize]--
+	}
+}
+
+//收到一个block，piece的所有block都到齐后返回整个piece，requested表示这个连接上是否还在等这个block
+func (p *picker) receive(index, begin int, data []byte, requested bool) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp := p.partial[index]
+	if pp == nil || begin%MaxBlockSize != 0 || begin/MaxBlockSize >= len(pp.received) {
+		return nil, false
+	}
+	block := begin / MaxBlockSize
+	if requested && pp.requested[block] > 0 {
+		pp.requested[block]--
+	}
+	if pp.received[block] || len(data) != p.block(index, block).length {
+		return nil, false
+	}
+
+	copy(pp.buf[begin:], data)
+	pp.received[block] = true
+	pp.left--
+	return pp.buf, pp.left == 0
+}
+
+//这个block是否已经不需要了，其他peer已经给过或者整个piece已经完成
+func (p *picker) received(req blockRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.have.HasPiece(req.index) {
+		return true
+	}
+	pp := p.partial[req.index]
+	return pp != nil && pp.received[req.begin/MaxBlockSize]
+}
+
+//piece校验没通过，所有block重新下载
+func (p *picker) reset(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp := p.partial[index]
+	if pp == nil {
+		return
+	}
+	for block := range pp.received {
+		pp.received[block] = false
+	}
+	pp.left = len(pp.received)
+}
+
+//piece校验通过，返回是不是第一次完成这个piece
+func (p *picker) finish(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.partial, index)
+	if p.have.HasPiece(index) {
+		return false
+	}
+	p.have.SetPiece(index)
+	p.left--
+	return true
+}
+
+//所有piece都已经下载完成
+func (p *picker) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left == 0
+}
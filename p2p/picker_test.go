@@ -0,0 +1,246 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//每个piece两个block
+const testPieceLength = 2 * MaxBlockSize
+
+func newBitfield(numPieces int, pieces ...int) bitfield.Bitfield {
+	bf := bitfield.New(numPieces)
+	for _, index := range pieces {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+func newTestPicker(numPieces int, have bitfield.Bitfield, priorities []Priority) *picker {
+	return newPicker(numPieces, testPieceLength, numPieces*testPieceLength, have, priorities)
+}
+
+func TestPickerRarest(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers [][]int
+		have  []int
+		from  []int
+		want  int
+		ok    bool
+	}{
+		{"rarest", [][]int{{0, 1, 2, 3}, {1, 2, 3}, {2, 3}}, nil, []int{0, 1, 2, 3}, 0, true},
+		{"skip have", [][]int{{0, 1, 2, 3}, {1, 2, 3}, {2, 3}}, []int{0}, []int{0, 1, 2, 3}, 1, true},
+		{"only what peer has", [][]int{{0, 1, 2, 3}, {1, 2, 3}, {2, 3}, {3}}, nil, []int{2, 3}, 2, true},
+		{"peer has nothing we want", [][]int{{0, 1}}, []int{0, 1}, []int{0, 1}, 0, false},
+		{"empty peer", [][]int{{0, 1, 2, 3}}, nil, nil, 0, false},
+	}
+	for _, tt := range tests {
+		p := newTestPicker(4, newBitfield(4, tt.have...), nil)
+		for _, pieces := range tt.peers {
+			p.addPeer(newBitfield(4, pieces...))
+		}
+		req, ok := p.nextBlock(newBitfield(4, tt.from...), nil, nil)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		if ok {
+			assert.Equal(t, blockRequest{tt.want, 0, MaxBlockSize}, req, tt.name)
+		}
+	}
+}
+
+func TestPickerAvailability(t *testing.T) {
+	p := newTestPicker(4, nil, nil)
+	a := newBitfield(4, 0, 1)
+	b := newBitfield(4, 1, 2)
+	p.addPeer(a)
+	p.addPeer(b)
+	assert.Equal(t, []int{1, 2, 1, 0}, p.availability)
+
+	//have消息只加一个piece，越界的忽略
+	p.peerHave(3)
+	p.peerHave(4)
+	assert.Equal(t, []int{1, 2, 1, 1}, p.availability)
+
+	p.removePeer(a)
+	assert.Equal(t, []int{0, 1, 1, 1}, p.availability)
+}
+
+func TestPickerTieBreak(t *testing.T) {
+	//4个piece一样稀有，多次挑选不应该总是同一个
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		p := newTestPicker(4, nil, nil)
+		p.addPeer(newBitfield(4, 0, 1, 2, 3))
+		req, ok := p.nextBlock(newBitfield(4, 0, 1, 2, 3), nil, nil)
+		require.True(t, ok)
+		seen[req.index] = true
+	}
+	assert.True(t, len(seen) > 1)
+}
+
+func TestPickerPartialFirst(t *testing.T) {
+	//已经开始的piece先下完，再开始新的piece
+	p := newTestPicker(4, nil, nil)
+	all := newBitfield(4, 0, 1, 2, 3)
+	first, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	second, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{first.index, MaxBlockSize, MaxBlockSize}, second)
+}
+
+func TestPickerRelease(t *testing.T) {
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	req, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+
+	//被choke之后block交回去，下一个peer可以重新请求
+	p.unrequest(req)
+	again, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, req, again)
+}
+
+func TestPickerFinish(t *testing.T) {
+	p := newTestPicker(3, newBitfield(3, 0), nil)
+	assert.Equal(t, 2, p.left)
+
+	assert.True(t, p.finish(1))
+	assert.Equal(t, 1, p.left)
+	assert.False(t, p.finished())
+
+	//同一个piece完成两次只算一次
+	assert.False(t, p.finish(1))
+	assert.Equal(t, 1, p.left)
+
+	assert.True(t, p.finish(2))
+	assert.True(t, p.finished())
+
+	//都有了之后不再挑piece
+	_, ok := p.nextBlock(newBitfield(3, 0, 1, 2), map[blockRequest]time.Time{}, nil)
+	assert.False(t, ok)
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	inflightA := make(map[blockRequest]time.Time)
+	for i := 0; i < 2; i++ {
+		req, ok := p.nextBlock(all, inflightA, nil)
+		require.True(t, ok)
+		inflightA[req] = time.Now()
+	}
+	assert.False(t, p.endgame)
+
+	//所有block都请求过之后，其他peer也可以请求同一个block
+	req, ok := p.nextBlock(all, map[blockRequest]time.Time{}, nil)
+	require.True(t, ok)
+	assert.True(t, p.endgame)
+	_, dup := inflightA[req]
+	assert.True(t, dup)
+
+	//同一个连接上不会重复请求
+	_, ok = p.nextBlock(all, inflightA, nil)
+	assert.False(t, ok)
+}
+
+func TestPickerLateBlock(t *testing.T) {
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	first, _ := p.nextBlock(all, nil, nil)
+	second, _ := p.nextBlock(all, nil, nil)
+	dupFirst, ok := p.nextBlock(all, map[blockRequest]time.Time{}, nil)
+	require.True(t, ok)
+	require.Equal(t, first, dupFirst)
+
+	data := make([]byte, MaxBlockSize)
+	_, complete := p.receive(0, first.begin, data, true)
+	assert.False(t, complete)
+	//另一个peer的同一个block已经不需要了，要发cancel
+	assert.True(t, p.received(dupFirst))
+
+	//cancel之前已经发出来的block被丢掉
+	_, complete = p.receive(0, dupFirst.begin, data, true)
+	assert.False(t, complete)
+
+	buf, complete := p.receive(0, second.begin, data, true)
+	assert.True(t, complete)
+	assert.Len(t, buf, testPieceLength)
+	assert.True(t, p.finish(0))
+
+	//piece完成之后迟到的block和重复的完成都不算
+	_, complete = p.receive(0, second.begin, data, true)
+	assert.False(t, complete)
+	assert.False(t, p.finish(0))
+	assert.True(t, p.finished())
+}
+
+func TestPickerTimedOut(t *testing.T) {
+	p := newTestPicker(1, nil, nil)
+	all := newBitfield(1, 0)
+	first, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+
+	//超时的block不马上交回给同一个连接
+	p.unrequest(first)
+	timedOut := map[blockRequest]bool{first: true}
+	second, ok := p.nextBlock(all, nil, timedOut)
+	require.True(t, ok)
+	assert.NotEqual(t, first, second)
+
+	//其他连接可以请求
+	other, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, first, other)
+	p.unrequest(other)
+
+	//没有别的block可以请求时才再交给这个连接
+	again, ok := p.nextBlock(all, map[blockRequest]time.Time{second: time.Now()}, timedOut)
+	require.True(t, ok)
+	assert.Equal(t, first, again)
+}
+
+func TestPickerSequential(t *testing.T) {
+	//piece 3最稀有，顺序模式下还是从piece 0开始
+	p := newTestPicker(4, newBitfield(4, 0), nil)
+	p.sequential = true
+	p.addPeer(newBitfield(4, 0, 1, 2, 3))
+	p.addPeer(newBitfield(4, 0, 1, 2))
+	all := newBitfield(4, 0, 1, 2, 3)
+
+	var order []int
+	for i := 0; i < 6; i++ {
+		req, ok := p.nextBlock(all, nil, nil)
+		require.True(t, ok)
+		order = append(order, req.index)
+	}
+	assert.Equal(t, []int{1, 1, 2, 2, 3, 3}, order)
+}
+
+func TestPickerUrgent(t *testing.T) {
+	p := newTestPicker(4, nil, []Priority{PriorityNormal, PriorityHigh, PriorityNormal, PrioritySkip})
+	all := newBitfield(4, 0, 1, 2, 3)
+
+	//高优先级文件的piece先下载
+	first, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, 1, first.index)
+
+	//Reader等着的piece比已经开始的高优先级piece还优先，跳过的piece即使Reader在读也不下载
+	p.setUrgent([]bool{false, false, true, true})
+	req, ok := p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{2, 0, MaxBlockSize}, req)
+	req, ok = p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{2, MaxBlockSize, MaxBlockSize}, req)
+
+	req, ok = p.nextBlock(all, nil, nil)
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{1, MaxBlockSize, MaxBlockSize}, req)
+}
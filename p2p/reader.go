@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//Reader当前位置之后多少字节的piece优先下载
+const readahead = 8 << 20
+
+//Close之后再Read或者Seek
+var ErrReaderClosed = errors.New("Reader closed")
+
+//边下载边读，读到还没下载的piece时阻塞等待，Reader位置附近的piece会被优先下载
+type Reader struct {
+	torr *Torrent
+	pos  int64
+	//最近读过的一个piece
+	index int
+	buf   []byte
+	//Close之后为true，由torr.mu保护
+	closed bool
+}
+
+func (torr *Torrent) NewReader() *Reader {
+	r := &Reader{torr: torr, index: -1}
+	torr.mu.Lock()
+	if torr.readers == nil {
+		torr.readers = make(map[*Reader]int)
+	}
+	torr.readers[r] = 0
+	torr.mu.Unlock()
+	torr.updateUrgent()
+	return r
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	torr := r.torr
+	if r.isClosed() {
+		return 0, ErrReaderClosed
+	}
+	if r.pos >= int64(torr.Length) {
+		return 0, io.EOF
+	}
+
+	index := int(r.pos / int64(torr.PieceLength))
+	if index != r.index {
+		err := r.setPiece(index)
+		if err != nil {
+			return 0, err
+		}
+		err = r.waitPiece(index)
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, torr.calculatePieceSize(index))
+		err = torr.Storage.ReadPiece(index, buf)
+		if err != nil {
+			return 0, err
+		}
+		r.index = index
+		r.buf = buf
+	}
+
+	begin, _ := torr.calculateBoundsForPiece(index)
+	n := copy(p, r.buf[int(r.pos)-begin:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if r.isClosed() {
+		return 0, ErrReaderClosed
+	}
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = int64(r.torr.Length) + offset
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.pos = pos
+
+	//提前把新位置附近的piece提到最前面
+	if pos < int64(r.torr.Length) {
+		err := r.setPiece(int(pos / int64(r.torr.PieceLength)))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+//不再读取，去掉这个Reader带来的优先级，正在等待piece的Read返回ErrReaderClosed
+func (r *Reader) Close() error {
+	r.torr.mu.Lock()
+	r.closed = true
+	delete(r.torr.readers, r)
+	r.torr.wakeReaders()
+	r.torr.mu.Unlock()
+	r.torr.updateUrgent()
+	return nil
+}
+
+func (r *Reader) isClosed() bool {
+	r.torr.mu.Lock()
+	defer r.torr.mu.Unlock()
+	return r.closed
+}
+
+//Close之后不会再加回readers
+func (r *Reader) setPiece(index int) error {
+	r.torr.mu.Lock()
+	if r.closed {
+		r.torr.mu.Unlock()
+		return ErrReaderClosed
+	}
+	old, ok := r.torr.readers[r]
+	r.torr.readers[r] = index
+	r.torr.mu.Unlock()
+	if !ok || old != index {
+		r.torr.updateUrgent()
+	}
+	return nil
+}
+
+//按照所有Reader的位置重新计算优先下载的piece
+func (torr *Torrent) updateUrgent() {
+	window := (readahead + torr.PieceLength - 1) / torr.PieceLength
+	urgent := make([]bool, len(torr.PieceHashes))
+
+	torr.mu.Lock()
+	for _, index := range torr.readers {
+		for i := index; i < index+window && i < len(urgent); i++ {
+			urgent[i] = true
+		}
+	}
+	pk := torr.picker
+	torr.mu.Unlock()
+
+	if pk != nil {
+		pk.setUrgent(urgent)
+	}
+}
+
+//等到piece下载并校验完成，下载结束或者Reader被关闭时还没有就返回错误
+func (r *Reader) waitPiece(index int) error {
+	torr := r.torr
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	if torr.cond == nil {
+		torr.cond = sync.NewCond(&torr.mu)
+	}
+	for !torr.Bitfield.HasPiece(index) {
+		if r.closed {
+			return ErrReaderClosed
+		}
+		if torr.stopped {
+			return fmt.Errorf("Piece #%d is not available, download stopped", index)
+		}
+		torr.cond.Wait()
+	}
+	return nil
+}
+
+//有新的piece或者下载结束，唤醒等待的Reader，调用时要持有torr.mu
+func (torr *Torrent) wakeReaders() {
+	if torr.cond != nil {
+		torr.cond.Broadcast()
+	}
+}
@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/bingnoi/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//正在下载的torrent，所有piece都还没有
+func newReaderTorrent(numPieces int) (*Torrent, []byte) {
+	data := make([]byte, numPieces*testPieceLength)
+	rand.Read(data)
+	torr := &Torrent{
+		PieceHashes: make([][20]byte, numPieces),
+		PieceLength: testPieceLength,
+		Length:      len(data),
+		Storage:     storage.NewMemoryStorage(len(data), testPieceLength),
+		Bitfield:    bitfield.New(numPieces),
+		picker:      newTestPicker(numPieces, nil, nil),
+	}
+	return torr, data
+}
+
+//模拟Download收到一个piece
+func gotPiece(t *testing.T, torr *Torrent, data []byte, index int) {
+	begin, end := torr.calculateBoundsForPiece(index)
+	require.Nil(t, torr.Storage.WritePiece(index, data[begin:end]))
+	torr.mu.Lock()
+	torr.Bitfield.SetPiece(index)
+	torr.wakeReaders()
+	torr.mu.Unlock()
+}
+
+//在后台读，返回读到的数据和错误
+func readAsync(r *Reader, n int) chan error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		done <- err
+	}()
+	return done
+}
+
+func TestReaderBlocks(t *testing.T) {
+	torr, data := newReaderTorrent(3)
+	r := torr.NewReader()
+	defer r.Close()
+
+	//Seek之后新位置的piece变成最优先
+	pos := int64(testPieceLength + 10)
+	_, err := r.Seek(pos, io.SeekStart)
+	require.Nil(t, err)
+	assert.Equal(t, []bool{false, true, true}, torr.picker.urgent)
+
+	buf := make([]byte, 100)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, buf)
+		read <- err
+	}()
+	select {
+	case <-read:
+		t.Fatal("Read returned before the piece arrived")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//piece下载完成后唤醒
+	gotPiece(t, torr, data, 1)
+	select {
+	case err := <-read:
+		require.Nil(t, err)
+		assert.Equal(t, data[pos:pos+100], buf)
+	case <-time.After(time.Second):
+		t.Fatal("Read not woken by new piece")
+	}
+
+	//读到文件末尾
+	gotPiece(t, torr, data, 2)
+	_, err = r.Seek(-10, io.SeekEnd)
+	require.Nil(t, err)
+	rest := make([]byte, 20)
+	n, err := io.ReadFull(r, rest)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, data[len(data)-10:], rest[:n])
+}
+
+func TestReaderStopped(t *testing.T) {
+	torr, _ := newReaderTorrent(2)
+	r := torr.NewReader()
+	defer r.Close()
+
+	read := readAsync(r, 10)
+	time.Sleep(20 * time.Millisecond)
+	//下载结束时还没有的piece不会再来
+	torr.stopDownload()
+	select {
+	case err := <-read:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read not woken by stopDownload")
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	torr, _ := newReaderTorrent(2)
+	r := torr.NewReader()
+
+	//关闭时正在等待的Read返回
+	read := readAsync(r, 10)
+	time.Sleep(20 * time.Millisecond)
+	require.Nil(t, r.Close())
+	select {
+	case err := <-read:
+		assert.Equal(t, ErrReaderClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read not woken by Close")
+	}
+
+	//Close之后不再加回readers，也不再影响优先级
+	_, err := r.Seek(testPieceLength, io.SeekStart)
+	assert.Equal(t, ErrReaderClosed, err)
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrReaderClosed, err)
+	torr.mu.Lock()
+	assert.Empty(t, torr.readers)
+	torr.mu.Unlock()
+	assert.Equal(t, []bool{false, false}, torr.picker.urgent)
+}
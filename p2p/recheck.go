@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+)
+
+//重新读取Storage里的数据并逐个piece校验，返回已经完整的piece
+func (torr *Torrent) Recheck() (bitfield.Bitfield, error) {
+	log.Println("Checking existing data of", torr.Name)
+
+	bf := bitfield.New(len(torr.PieceHashes))
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	//多个协程并行读盘和计算哈希
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				pw := &filePiece{index, torr.PieceHashes[index], torr.calculatePieceSize(index)}
+				buf := make([]byte, pw.length)
+				err := torr.Storage.ReadPiece(index, buf)
+				if err != nil {
+					continue
+				}
+				if checkIntegrity(pw, buf) != nil {
+					continue
+				}
+				mu.Lock()
+				bf.SetPiece(index)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for index := range torr.PieceHashes {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	have := 0
+	for index := range torr.PieceHashes {
+		if bf.HasPiece(index) {
+			have++
+		}
+	}
+	log.Printf("Recheck done, %d of %d pieces already present\n", have, len(torr.PieceHashes))
+	return bf, nil
+}
+
+//设置已经有的piece，同时标记到Storage里，让Storage.HasPiece和Bitfield一致
+func (torr *Torrent) SetBitfield(bf bitfield.Bitfield) {
+	torr.mu.Lock()
+	torr.Bitfield = bf
+	torr.mu.Unlock()
+	for index := range torr.PieceHashes {
+		if bf.HasPiece(index) {
+			torr.Storage.MarkPiece(index)
+		}
+	}
+}
+
+//需要下载的piece是否都已经有了，跳过的piece不算
+func (torr *Torrent) Done() bool {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	for index := range torr.PieceHashes {
+		skip := index < len(torr.Priorities) && torr.Priorities[index] == PrioritySkip
+		if !skip && !torr.Bitfield.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+//所有piece是否都已经下载完成
+func (torr *Torrent) Complete() bool {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	for index := range torr.PieceHashes {
+		if !torr.Bitfield.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package p2p
+
+import (
+	"log"
+)
+
+//做种：下载完成后继续给其他peer上传，直到done被关闭
+func (torr *Torrent) Seed(done <-chan struct{}) {
+	log.Println("Now, We are seeding file : ", torr.Name)
+
+	torr.mu.Lock()
+	torr.seeding = true
+	if torr.active == nil {
+		torr.active = make(map[string]bool)
+	}
+	peerList := torr.Peers
+	torr.Peers = nil
+	torr.mu.Unlock()
+	torr.AddPeers(peerList)
+
+	<-done
+
+	//断开所有连接，runPeer读写出错后自己退出
+	torr.mu.Lock()
+	torr.seeding = false
+	for c := range torr.clients {
+		c.Conn.Close()
+	}
+	torr.mu.Unlock()
+}
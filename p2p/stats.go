@@ -0,0 +1,41 @@
+package p2p
+
+import (
+	"sync/atomic"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/bingnoi/bittorrent/peers"
+)
+
+//下载过程中的状态快照，给续传文件和tracker用
+type Stats struct {
+	Bitfield   bitfield.Bitfield
+	Downloaded int64
+	Uploaded   int64
+	Left       int64
+	Peers      []peers.Peer
+}
+
+func (torr *Torrent) Stats() Stats {
+	torr.mu.Lock()
+	bf := make(bitfield.Bitfield, len(torr.Bitfield))
+	copy(bf, torr.Bitfield)
+	peerList := make([]peers.Peer, len(torr.Peers))
+	copy(peerList, torr.Peers)
+	torr.mu.Unlock()
+
+	var left int64
+	for index := range torr.PieceHashes {
+		if !bf.HasPiece(index) {
+			left += int64(torr.calculatePieceSize(index))
+		}
+	}
+
+	return Stats{
+		Bitfield:   bf,
+		Downloaded: atomic.LoadInt64(&torr.Downloaded),
+		Uploaded:   atomic.LoadInt64(&torr.Uploaded),
+		Left:       left,
+		Peers:      peerList,
+	}
+}
@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/bingnoi/bittorrent/client"
+	"github.com/bingnoi/bittorrent/message"
+)
+
+//对方一次最多能请求的长度，超过的request直接丢掉
+const MaxRequestLength = 128 * 1024
+
+//每个连接缓存最近读过的一个piece，对方一般会连续请求同一个piece里的block
+type pieceCache struct {
+	index int
+	buf   []byte
+}
+
+//处理除了piece以外的消息，下载和上传时都走这里
+func (torr *Torrent) handleMessage(c *client.Client, msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgUnchoke:
+		c.Choked = false
+	case message.MsgChoke:
+		c.Choked = true
+	case message.MsgInterested:
+		c.SetPeerInterested(true)
+		torr.peerInterested(c)
+	case message.MsgNotInterested:
+		c.SetPeerInterested(false)
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if !c.Bitfield.HasPiece(index) {
+			c.Bitfield.SetPiece(index)
+			if pk := torr.currentPicker(); pk != nil {
+				pk.peerHave(index)
+			}
+		}
+	case message.MsgBitfield:
+		bf := bitfield.New(len(torr.PieceHashes))
+		copy(bf, msg.Payload)
+		if pk := torr.currentPicker(); pk != nil {
+			pk.removePeer(c.Bitfield)
+			pk.addPeer(bf)
+		}
+		c.Bitfield = bf
+	case message.MsgRequest:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		c.QueueRequest(client.Request{Index: index, Begin: begin, Length: length})
+	case message.MsgCancel:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		c.CancelRequest(client.Request{Index: index, Begin: begin, Length: length})
+	case message.MsgExtended:
+		if c.Extensions {
+			return c.HandleExtended(msg)
+		}
+	}
+	return nil
+}
+
+//我们是否已经有了这个piece
+func (torr *Torrent) hasPiece(index int) bool {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	return torr.Bitfield.HasPiece(index)
+}
+
+//当前bitfield的拷贝，用来发给新连接的peer
+func (torr *Torrent) bitfieldSnapshot() bitfield.Bitfield {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	bf := bitfield.New(len(torr.PieceHashes))
+	copy(bf, torr.Bitfield)
+	return bf
+}
+
+//把对方排队的request都回复掉，不合法的request直接丢掉
+func (torr *Torrent) serveRequests(c *client.Client, cache *pieceCache) error {
+	for {
+		req, ok := c.NextRequest()
+		if !ok {
+			return nil
+		}
+		if c.AmChoking() {
+			continue
+		}
+		if req.Index < 0 || req.Index >= len(torr.PieceHashes) || !torr.hasPiece(req.Index) {
+			continue
+		}
+		size := torr.calculatePieceSize(req.Index)
+		if req.Length <= 0 || req.Length > MaxRequestLength || req.Begin < 0 || req.Begin+req.Length > size {
+			log.Printf("Peer %s sent bad request for piece #%d\n", c.Peer().IP, req.Index)
+			continue
+		}
+
+		if cache.buf == nil || cache.index != req.Index {
+			buf := make([]byte, size)
+			err := torr.Storage.ReadPiece(req.Index, buf)
+			if err != nil {
+				return err
+			}
+			cache.index = req.Index
+			cache.buf = buf
+		}
+
+		err := c.SendPiece(req.Index, req.Begin, cache.buf[req.Begin:req.Begin+req.Length])
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&torr.Uploaded, int64(req.Length))
+		c.AddUploaded(req.Length)
+	}
+}
+
+//新下载完成一个piece，通知所有连接着的peer
+func (torr *Torrent) broadcastHave(index int) {
+	torr.mu.Lock()
+	conns := make([]*client.Client, 0, len(torr.clients))
+	for c := range torr.clients {
+		conns = append(conns, c)
+	}
+	torr.mu.Unlock()
+
+	for _, c := range conns {
+		c.SendHave(index)
+	}
+}
+
+//Close之后返回false，连接直接断开
+func (torr *Torrent) addClient(c *client.Client) bool {
+	torr.mu.Lock()
+	defer torr.mu.Unlock()
+	select {
+	case <-torr.closedChan():
+		return false
+	default:
+	}
+	if torr.clients == nil {
+		torr.clients = make(map[*client.Client]bool)
+	}
+	torr.clients[c] = true
+	torr.startChoker()
+	return true
+}
+
+func (torr *Torrent) removeClient(c *client.Client) {
+	torr.mu.Lock()
+	delete(torr.clients, c)
+	torr.mu.Unlock()
+}
@@ -10,10 +10,21 @@ import (
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	//字典格式的peer列表里会带peer id，compact格式没有
+	ID [20]byte
 }
 
 func Unmarshal(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6
+	return unmarshalCompact(peersBin, net.IPv4len)
+}
+
+//BEP 7：peers6里每个peer是16字节IPv6地址加2字节端口
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshalCompact(peersBin, net.IPv6len)
+}
+
+func unmarshalCompact(peersBin []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin)%peerSize != 0 {
 		err := fmt.Errorf("ERROR, Format not right")
@@ -22,8 +33,38 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
+		peers[i].IP = net.IP(peersBin[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+ipLen : offset+peerSize]))
+	}
+	return peers, nil
+}
+
+//BEP 3原始的字典格式：每个peer是一个含ip、port、peer id的字典，参数是bencode解码后的列表
+func UnmarshalDicts(list []interface{}) ([]Peer, error) {
+	var peers []Peer
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("ERROR, peer is not a dictionary")
+		}
+
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("ERROR, peer %s has bad port %d", host, port)
+		}
+
+		//ip可能是IPv4、IPv6或者域名，解析tracker响应时不做DNS查询，域名的peer直接跳过
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+
+		p := Peer{IP: ip, Port: uint16(port)}
+		if id, ok := dict["peer id"].(string); ok {
+			copy(p.ID[:], id)
+		}
+		peers = append(peers, p)
 	}
 	return peers, nil
 }
@@ -31,3 +72,35 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
+
+//按照compact格式编码，非IPv4地址会被跳过
+func Marshal(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*6)
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = appendCompact(buf, ip, p.Port)
+	}
+	return buf
+}
+
+//按照peers6格式编码，只包含IPv6地址
+func Marshal6(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*18)
+	for _, p := range peers {
+		if p.IP.To4() != nil || p.IP.To16() == nil {
+			continue
+		}
+		buf = appendCompact(buf, p.IP.To16(), p.Port)
+	}
+	return buf
+}
+
+func appendCompact(buf []byte, ip net.IP, port uint16) []byte {
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], port)
+	buf = append(buf, ip...)
+	return append(buf, portBuf[:]...)
+}
@@ -0,0 +1,55 @@
+package peers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalDicts(t *testing.T) {
+	list := []interface{}{
+		map[string]interface{}{"ip": "10.0.0.1", "port": int64(6881), "peer id": "-GT0001-abcdefghijkl"},
+		map[string]interface{}{"ip": "2001:db8::1", "port": int64(51413)},
+		//域名不解析，直接跳过
+		map[string]interface{}{"ip": "peer.example.com", "port": int64(6881)},
+	}
+	peers, err := UnmarshalDicts(list)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+
+	assert.Equal(t, "10.0.0.1:6881", peers[0].String())
+	assert.Equal(t, "-GT0001-abcdefghijkl", string(peers[0].ID[:]))
+	assert.Equal(t, "[2001:db8::1]:51413", peers[1].String())
+	assert.Equal(t, [20]byte{}, peers[1].ID)
+}
+
+func TestUnmarshalDictsBad(t *testing.T) {
+	tests := map[string][]interface{}{
+		"not a dictionary": {"10.0.0.1:6881"},
+		"missing port":     {map[string]interface{}{"ip": "10.0.0.1"}},
+		"port too large":   {map[string]interface{}{"ip": "10.0.0.1", "port": int64(70000)}},
+	}
+	for name, list := range tests {
+		_, err := UnmarshalDicts(list)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestUnmarshal6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::2")
+	peers, err := Unmarshal6(append(append([]byte{}, ip...), 0x1a, 0xe1))
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "[2001:db8::2]:6881", peers[0].String())
+
+	_, err = Unmarshal6(make([]byte, 17))
+	assert.NotNil(t, err)
+
+	//Marshal6只编码IPv6地址，和Unmarshal6互逆
+	mixed := []Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 1}, peers[0]}
+	round, err := Unmarshal6(Marshal6(mixed))
+	require.Nil(t, err)
+	assert.Equal(t, peers, round)
+}
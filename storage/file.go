@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//只读打开时文件不存在或者长度不够
+var ErrMissing = errors.New("Piece data missing on disk")
+
+//普通文件存储，用WriteAt/ReadAt直接读写对应偏移
+type FileStorage struct {
+	*pieceSet
+	layout
+	files []*os.File
+	//跳过的文件对应的.part文件，其他文件为nil
+	parts []*partFile
+}
+
+//打开(必要时创建)所有输出文件，并预先分配好大小，跳过的文件不创建
+func NewFileStorage(infos []FileInfo, pieceLength int) (*FileStorage, error) {
+	s := &FileStorage{layout: newLayout(infos, pieceLength)}
+	s.pieceSet = newPieceSet(s.numPieces())
+	s.parts = newPartFiles(infos)
+
+	for _, info := range infos {
+		if info.Skip {
+			s.files = append(s.files, nil)
+			continue
+		}
+		f, err := openFile(info)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+//只读打开已有的文件，不创建也不改大小，缺少的文件在读取时返回ErrMissing
+func OpenFileStorage(infos []FileInfo, pieceLength int) (*FileStorage, error) {
+	s := &FileStorage{layout: newLayout(infos, pieceLength)}
+	s.pieceSet = newPieceSet(s.numPieces())
+	s.parts = newPartFiles(infos)
+
+	for _, info := range infos {
+		if info.Skip {
+			s.files = append(s.files, nil)
+			continue
+		}
+		f, err := os.Open(info.Path)
+		if os.IsNotExist(err) {
+			s.files = append(s.files, nil)
+			continue
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+//打开文件并把大小调整到torrent中记录的长度
+func openFile(info FileInfo) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(info.Path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(info.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.Size() != int64(info.Length) {
+		err = f.Truncate(int64(info.Length))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+//和跳过的文件重叠的部分写到.part文件里
+func (s *FileStorage) WritePiece(index int, buf []byte) error {
+	err := s.span(index, len(buf), func(i int, off int64, lo, hi int) error {
+		if s.parts[i] != nil {
+			return s.parts[i].WriteAt(buf[lo:hi], off)
+		}
+		if s.files[i] == nil {
+			return nil
+		}
+		_, err := s.files[i].WriteAt(buf[lo:hi], off)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.MarkPiece(index)
+	return nil
+}
+
+func (s *FileStorage) ReadPiece(index int, buf []byte) error {
+	return s.span(index, len(buf), func(i int, off int64, lo, hi int) error {
+		if s.parts[i] != nil {
+			return s.parts[i].ReadAt(buf[lo:hi], off)
+		}
+		if s.files[i] == nil {
+			return ErrMissing
+		}
+		_, err := s.files[i].ReadAt(buf[lo:hi], off)
+		if err == io.EOF {
+			return ErrMissing
+		}
+		return err
+	})
+}
+
+func (s *FileStorage) Close() error {
+	firstErr := closeParts(s.parts)
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
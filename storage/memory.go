@@ -0,0 +1,45 @@
+package storage
+
+//内存存储，适合小文件或者调用方自己再把数据转存到别处
+type MemoryStorage struct {
+	*pieceSet
+	layout
+	buf []byte
+}
+
+func NewMemoryStorage(length, pieceLength int) *MemoryStorage {
+	s := &MemoryStorage{
+		layout: newLayout([]FileInfo{{Length: length}}, pieceLength),
+		buf:    make([]byte, length),
+	}
+	s.pieceSet = newPieceSet(s.numPieces())
+	return s
+}
+
+func (s *MemoryStorage) WritePiece(index int, buf []byte) error {
+	err := s.span(index, len(buf), func(_ int, off int64, lo, hi int) error {
+		copy(s.buf[off:], buf[lo:hi])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.MarkPiece(index)
+	return nil
+}
+
+func (s *MemoryStorage) ReadPiece(index int, buf []byte) error {
+	return s.span(index, len(buf), func(_ int, off int64, lo, hi int) error {
+		copy(buf[lo:hi], s.buf[off:])
+		return nil
+	})
+}
+
+//返回整个payload，下载完成之后调用
+func (s *MemoryStorage) Bytes() []byte {
+	return s.buf
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+//mmap存储，把每个输出文件整个映射进内存，读写就是内存拷贝，由内核负责刷盘
+type MmapStorage struct {
+	*pieceSet
+	layout
+	files []*os.File
+	maps  [][]byte
+	//跳过的文件对应的.part文件，其他文件为nil
+	parts []*partFile
+}
+
+func NewMmapStorage(infos []FileInfo, pieceLength int) (*MmapStorage, error) {
+	s := &MmapStorage{layout: newLayout(infos, pieceLength)}
+	s.pieceSet = newPieceSet(s.numPieces())
+	s.parts = newPartFiles(infos)
+
+	for _, info := range infos {
+		if info.Skip {
+			s.files = append(s.files, nil)
+			s.maps = append(s.maps, nil)
+			continue
+		}
+		f, err := openFile(info)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+
+		//空文件不能映射
+		if info.Length == 0 {
+			s.maps = append(s.maps, nil)
+			continue
+		}
+		m, err := syscall.Mmap(int(f.Fd()), 0, info.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps = append(s.maps, m)
+	}
+	return s, nil
+}
+
+func (s *MmapStorage) WritePiece(index int, buf []byte) error {
+	err := s.span(index, len(buf), func(i int, off int64, lo, hi int) error {
+		//跳过的文件写到.part文件里
+		if s.parts[i] != nil {
+			return s.parts[i].WriteAt(buf[lo:hi], off)
+		}
+		if s.maps[i] != nil {
+			copy(s.maps[i][off:], buf[lo:hi])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.MarkPiece(index)
+	return nil
+}
+
+func (s *MmapStorage) ReadPiece(index int, buf []byte) error {
+	return s.span(index, len(buf), func(i int, off int64, lo, hi int) error {
+		if s.parts[i] != nil {
+			return s.parts[i].ReadAt(buf[lo:hi], off)
+		}
+		if s.maps[i] == nil {
+			return ErrMissing
+		}
+		copy(buf[lo:hi], s.maps[i][off:])
+		return nil
+	})
+}
+
+func (s *MmapStorage) Close() error {
+	firstErr := closeParts(s.parts)
+	for _, m := range s.maps {
+		if m == nil {
+			continue
+		}
+		err := syscall.Munmap(m)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,12 @@
+package storage
+
+import "fmt"
+
+//windows下没有syscall.Mmap，直接报错，调用方可以退回FileStorage
+type MmapStorage struct {
+	FileStorage
+}
+
+func NewMmapStorage(infos []FileInfo, pieceLength int) (*MmapStorage, error) {
+	return nil, fmt.Errorf("Mmap storage is not supported on windows")
+}
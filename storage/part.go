@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//跳过的文件里和需要的文件共用一个piece的那部分数据，保存在文件旁边的.part文件里，
+//按照原文件里的偏移写入，只有边界上的piece会用到，所以是一个很小的稀疏文件
+type partFile struct {
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	writable bool
+}
+
+//每个跳过的文件一个partFile，用到时才创建
+func newPartFiles(infos []FileInfo) []*partFile {
+	parts := make([]*partFile, len(infos))
+	for i, info := range infos {
+		if info.Skip {
+			parts[i] = &partFile{path: info.Path + ".part"}
+		}
+	}
+	return parts
+}
+
+func closeParts(parts []*partFile) error {
+	var firstErr error
+	for _, p := range parts {
+		if p == nil {
+			continue
+		}
+		err := p.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *partFile) WriteAt(buf []byte, off int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	//只读打开过的要重新以读写方式打开
+	if p.f == nil || !p.writable {
+		err := os.MkdirAll(filepath.Dir(p.path), 0755)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if p.f != nil {
+			p.f.Close()
+		}
+		p.f = f
+		p.writable = true
+	}
+	_, err := p.f.WriteAt(buf, off)
+	return err
+}
+
+//没有写过的部分返回ErrMissing
+func (p *partFile) ReadAt(buf []byte, off int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.f == nil {
+		f, err := os.Open(p.path)
+		if os.IsNotExist(err) {
+			return ErrMissing
+		}
+		if err != nil {
+			return err
+		}
+		p.f = f
+	}
+	_, err := p.f.ReadAt(buf, off)
+	if err == io.EOF {
+		return ErrMissing
+	}
+	return err
+}
+
+func (p *partFile) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return nil
+	}
+	err := p.f.Close()
+	p.f = nil
+	return err
+}
@@ -0,0 +1,107 @@
+/*storage负责保存校验过的piece，p2p只通过Storage接口读写，
+具体数据落在哪里(磁盘文件、内存、mmap或者调用方自己的存储)由实现决定
+*/
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+)
+
+type Storage interface {
+	//读取一个完整的piece，buf的长度就是这个piece的长度
+	ReadPiece(index int, buf []byte) error
+	//写入一个校验过的piece
+	WritePiece(index int, buf []byte) error
+	//这个piece是否已经写进来了
+	HasPiece(index int) bool
+	//标记一个之前就已经在存储里并且校验过的piece，比如续传时
+	MarkPiece(index int)
+	Close() error
+}
+
+//输出文件，按torrent中的顺序排列
+type FileInfo struct {
+	Path   string
+	Length int
+	//不需要的文件不创建，和需要的文件共用一个piece的部分写到旁边的.part文件里
+	Skip bool
+}
+
+//记录piece在各个文件中的位置
+type layout struct {
+	infos       []FileInfo
+	pieceLength int
+	length      int
+}
+
+func newLayout(infos []FileInfo, pieceLength int) layout {
+	l := layout{infos: infos, pieceLength: pieceLength}
+	for _, info := range infos {
+		l.length += info.Length
+	}
+	return l
+}
+
+func (l *layout) numPieces() int {
+	if l.pieceLength <= 0 {
+		return 0
+	}
+	return (l.length + l.pieceLength - 1) / l.pieceLength
+}
+
+//把piece按文件边界切开，fn拿到文件序号、文件内偏移以及对应buf[lo:hi]
+func (l *layout) span(index int, n int, fn func(file int, fileOffset int64, lo, hi int) error) error {
+	offset := index * l.pieceLength
+	if index < 0 || offset+n > l.length {
+		return fmt.Errorf("Piece %d [%d, %d) out of bounds, total %d", index, offset, offset+n, l.length)
+	}
+
+	begin := 0
+	pos := 0
+	for i, info := range l.infos {
+		end := begin + info.Length
+		if pos == n {
+			break
+		}
+		if offset < end {
+			size := end - offset
+			if size > n-pos {
+				size = n - pos
+			}
+			err := fn(i, int64(offset-begin), pos, pos+size)
+			if err != nil {
+				return err
+			}
+			pos += size
+			offset += size
+		}
+		begin = end
+	}
+	return nil
+}
+
+//已经写入的piece集合，下载协程和上传协程会同时访问
+type pieceSet struct {
+	mu   sync.RWMutex
+	have bitfield.Bitfield
+}
+
+func newPieceSet(numPieces int) *pieceSet {
+	return &pieceSet{have: bitfield.New(numPieces)}
+}
+
+func (p *pieceSet) HasPiece(index int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.have.HasPiece(index)
+}
+
+func (p *pieceSet) MarkPiece(index int) {
+	p.mu.Lock()
+	p.have.SetPiece(index)
+	p.mu.Unlock()
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkippedFileBoundary(t *testing.T) {
+	constructors := map[string]func([]FileInfo, int) (Storage, error){
+		"file": func(infos []FileInfo, pieceLength int) (Storage, error) {
+			return NewFileStorage(infos, pieceLength)
+		},
+		"mmap": func(infos []FileInfo, pieceLength int) (Storage, error) {
+			return NewMmapStorage(infos, pieceLength)
+		},
+	}
+
+	for name, newStorage := range constructors {
+		dir, err := ioutil.TempDir("", "storage")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		//piece 1跨越a和跳过的b
+		infos := []FileInfo{
+			{Path: filepath.Join(dir, "a"), Length: 40000},
+			{Path: filepath.Join(dir, "sub", "b"), Length: 30000, Skip: true},
+		}
+		piece := make([]byte, 32768)
+		rand.Read(piece)
+
+		st, err := newStorage(infos, 32768)
+		if err != nil {
+			t.Log(name, "not supported:", err)
+			continue
+		}
+		require.Nil(t, st.WritePiece(1, piece), name)
+		assert.True(t, st.HasPiece(1), name)
+
+		buf := make([]byte, len(piece))
+		require.Nil(t, st.ReadPiece(1, buf), name)
+		assert.Equal(t, piece, buf, name)
+
+		//没有写过的跳过部分还是缺失
+		assert.Equal(t, ErrMissing, st.ReadPiece(2, make([]byte, 70000-2*32768)), name)
+		require.Nil(t, st.Close(), name)
+
+		//跳过的文件不创建，重叠部分保存在.part里
+		_, err = os.Stat(infos[1].Path)
+		assert.True(t, os.IsNotExist(err), name)
+		_, err = os.Stat(infos[1].Path + ".part")
+		assert.Nil(t, err, name)
+
+		//只读重新打开之后边界上的piece仍然完整
+		ro, err := OpenFileStorage(infos, 32768)
+		require.Nil(t, err, name)
+		buf = make([]byte, len(piece))
+		require.Nil(t, ro.ReadPiece(1, buf), name)
+		assert.Equal(t, piece, buf, name)
+		ro.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package torrentfile
+
+import (
+	"log"
+	"time"
+
+	"github.com/bingnoi/bittorrent/p2p"
+)
+
+//所有tracker都失败之后多久再试
+const trackerRetry = time.Minute
+
+//用下载的实时状态生成announce请求
+func progressRequest(torrent *p2p.Torrent, peerID [20]byte, event string) *AnnounceRequest {
+	stats := torrent.Stats()
+	return &AnnounceRequest{
+		PeerID:     peerID,
+		Port:       Port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+	}
+}
+
+//下载期间按照tracker给的间隔重新announce，把新的peer交给正在下载的torrent
+func (torr *TorrentFile) announceLoop(torrent *p2p.Torrent, peerID [20]byte, wait time.Duration, stop chan struct{}) {
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		resp, err := torr.requestPeers(progressRequest(torrent, peerID, EventNone), torrent.AddPeers)
+		if err != nil {
+			log.Println("Announce failed:", err)
+			wait = trackerRetry
+			continue
+		}
+		log.Printf("Announce...OK, %d peers, %d seeders, %d leechers, next in %s\n", len(resp.Peers), resp.Complete, resp.Incomplete, resp.wait())
+		torrent.AddPeers(resp.Peers)
+		wait = resp.wait()
+	}
+}
+
+//发送一次带事件的announce，只记录错误
+func (torr *TorrentFile) announceEvent(torrent *p2p.Torrent, peerID [20]byte, event string) {
+	_, err := torr.requestPeers(progressRequest(torrent, peerID, event), nil)
+	if err != nil {
+		log.Printf("Announce %s failed: %s\n", event, err)
+	}
+}
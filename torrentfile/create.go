@@ -0,0 +1,202 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingnoi/bittorrent/storage"
+	"github.com/jackpal/bencode-go"
+)
+
+//自动选择piece大小时的上下限，以及希望得到的piece数量
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500
+)
+
+//生成torrent时的可选项，PieceLength为0时自动选择
+type CreateOptions struct {
+	PieceLength  int
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	Private      bool
+}
+
+//根据文件或目录生成bencode编码的torrent
+func Create(root string, opts CreateOptions) ([]byte, error) {
+	files, total, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	//没有数据的torrent没有piece，单文件时length还会因为omitempty被丢掉
+	if total == 0 {
+		return nil, fmt.Errorf("Error! %s has no data, nothing to share", root)
+	}
+
+	//root是"."之类的相对路径时，取绝对路径的最后一级做名字
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(total)
+	}
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("Error! piece length %d not right", pieceLength)
+	}
+
+	info := bencodeInfo{
+		PieceLength: pieceLength,
+		Name:        filepath.Base(abs),
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	//单个文件和目录的info结构不一样
+	var infos []storage.FileInfo
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, bencodeFile{Length: f.Length, Path: f.Path})
+			infos = append(infos, storage.FileInfo{
+				Path:   filepath.Join(append([]string{root}, f.Path...)...),
+				Length: f.Length,
+			})
+		}
+	} else {
+		info.Length = total
+		infos = []storage.FileInfo{{Path: root, Length: total}}
+	}
+
+	pieces, err := hashPieces(infos, pieceLength, total)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces = string(pieces)
+
+	bto := bencodeTorrent{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		Info:         info,
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, bto)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//遍历目录，按路径顺序列出所有普通文件
+func collectFiles(root string) ([]File, int, error) {
+	var files []File
+	total := 0
+	err := filepath.Walk(root, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !stat.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{
+			Length: int(stat.Size()),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		total += int(stat.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(files) == 0 {
+		return nil, 0, fmt.Errorf("Error! no files found in %s", root)
+	}
+	return files, total, nil
+}
+
+//让piece数量接近targetPieces，piece大小取2的幂
+func autoPieceLength(total int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && total/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+//多个协程并行计算每个piece的哈希，按顺序拼起来
+func hashPieces(infos []storage.FileInfo, pieceLength, total int) ([]byte, error) {
+	st, err := storage.OpenFileStorage(infos, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	numPieces := (total + pieceLength - 1) / pieceLength
+	pieces := make([]byte, numPieces*20)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				end := (index + 1) * pieceLength
+				if end > total {
+					end = total
+				}
+				piece := buf[:end-index*pieceLength]
+				err := st.ReadPiece(index, piece)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				hash := sha1.Sum(piece)
+				copy(pieces[index*20:], hash[:])
+			}
+		}()
+	}
+
+	for index := 0; index < numPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return pieces, nil
+}
@@ -0,0 +1,86 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	torr, _, datas := createTorrent(t, dir, []string{"a", "b"}, []int{40000, 30000}, 32768)
+	assert.Equal(t, "src", torr.Name)
+	assert.Equal(t, 70000, torr.Length)
+	assert.Equal(t, 32768, torr.PieceLength)
+	assert.Equal(t, []File{{40000, []string{"a"}}, {30000, []string{"b"}}}, torr.Files)
+
+	//每个piece的哈希按文件顺序拼起来计算
+	payload := append(append([]byte{}, datas[0]...), datas[1]...)
+	require.Len(t, torr.PieceHashes, 3)
+	for index, hash := range torr.PieceHashes {
+		begin := index * torr.PieceLength
+		end := begin + torr.PieceLength
+		if end > len(payload) {
+			end = len(payload)
+		}
+		assert.Equal(t, sha1.Sum(payload[begin:end]), hash, "piece #%d", index)
+	}
+
+	//info hash和重新编码info字典得到的一样，没有tracker时不写announce
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "test.torrent"))
+	require.Nil(t, err)
+	decoded, err := bencode.Decode(bytes.NewReader(buf))
+	require.Nil(t, err)
+	dict := decoded.(map[string]interface{})
+	_, ok := dict["announce"]
+	assert.False(t, ok)
+
+	var info bytes.Buffer
+	require.Nil(t, bencode.Marshal(&info, dict["info"]))
+	assert.Equal(t, sha1.Sum(info.Bytes()), torr.InfoHash)
+	assert.Equal(t, info.Bytes(), torr.RawInfo)
+}
+
+func TestCreateCurrentDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "payload")
+	require.Nil(t, os.Mkdir(src, 0755))
+	writeFiles(t, src, []string{"a"}, []int{1000})
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(src))
+	defer os.Chdir(wd)
+
+	buf, err := Create(".", CreateOptions{Announce: "http://tracker.example/announce"})
+	require.Nil(t, err)
+	bto := bencodeTorrent{}
+	require.Nil(t, bencode.Unmarshal(bytes.NewReader(buf), &bto))
+	assert.Equal(t, "payload", bto.Info.Name)
+	assert.Equal(t, "http://tracker.example/announce", bto.Announce)
+}
+
+func TestCreateEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	//空文件和只有空文件的目录都不能生成torrent
+	writeFiles(t, dir, []string{"empty"}, []int{0})
+	_, err = Create(filepath.Join(dir, "empty"), CreateOptions{})
+	assert.NotNil(t, err)
+	_, err = Create(dir, CreateOptions{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,80 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log"
+
+	"github.com/bingnoi/bittorrent/magnet"
+	"github.com/bingnoi/bittorrent/p2p"
+	"github.com/jackpal/bencode-go"
+)
+
+//下载metadata之前announce时报的left，大小还不知道
+const unknownLeft = 1
+
+//解析magnet链接，从peer那里下载info字典，之后和打开.torrent文件一样使用
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	log.Printf("Magnet %x ... OK\n", m.InfoHash)
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	//magnet里的每个tracker各自作为一级
+	torr := TorrentFile{InfoHash: m.InfoHash, Name: m.Name}
+	for _, tr := range m.Trackers {
+		torr.AnnounceList = append(torr.AnnounceList, []string{tr})
+	}
+	//还不知道总长度，left报一个非0值，tracker才会把我们当成leecher返回有metadata的做种者；
+	//不带事件，started留给之后的DownloadAndSeed
+	peerList := m.ResolvePeers()
+	resp, err := torr.requestPeers(&AnnounceRequest{PeerID: peerID, Port: Port, Left: unknownLeft}, nil)
+	if err != nil {
+		log.Println("Tracker failed:", err)
+	} else {
+		peerList = mergePeers(peerList, resp.Peers)
+	}
+
+	if len(peerList) == 0 {
+		return TorrentFile{}, fmt.Errorf("No peers found for magnet %x", m.InfoHash)
+	}
+
+	raw, err := p2p.FetchMetadata(peerList, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	//info字典已经按照info hash校验过，直接当成torrent的info部分解析
+	bto := bencodeTorrent{AnnounceList: torr.AnnounceList}
+	err = bencode.Unmarshal(bytes.NewReader(raw), &bto.Info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	res, err := bto.toTorrentFile(raw)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	res.extraPeers = peerList
+
+	//so参数只下载选中的文件
+	if len(m.Select) > 0 {
+		files, err := magnet.SelectedFiles(m.Select, len(res.Files))
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		err = res.SelectFiles(files)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	return res, nil
+}
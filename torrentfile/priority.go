@@ -0,0 +1,71 @@
+package torrentfile
+
+import (
+	"fmt"
+
+	"github.com/bingnoi/bittorrent/p2p"
+)
+
+//设置某个文件的优先级，p2p.PrioritySkip表示不下载
+func (torr *TorrentFile) SetFilePriority(file int, priority p2p.Priority) error {
+	if file < 0 || file >= len(torr.Files) {
+		return fmt.Errorf("File index %d out of range, torrent has %d files", file, len(torr.Files))
+	}
+	if torr.FilePriorities == nil {
+		torr.FilePriorities = make([]p2p.Priority, len(torr.Files))
+	}
+	torr.FilePriorities[file] = priority
+	return nil
+}
+
+//只下载选中的文件，其余的跳过
+func (torr *TorrentFile) SelectFiles(files []int) error {
+	selected := make(map[int]bool)
+	for _, file := range files {
+		if file < 0 || file >= len(torr.Files) {
+			return fmt.Errorf("File index %d out of range, torrent has %d files", file, len(torr.Files))
+		}
+		selected[file] = true
+	}
+	for file := range torr.Files {
+		if !selected[file] {
+			torr.SetFilePriority(file, p2p.PrioritySkip)
+		} else if torr.filePriority(file) == p2p.PrioritySkip {
+			torr.SetFilePriority(file, p2p.PriorityNormal)
+		}
+	}
+	return nil
+}
+
+func (torr *TorrentFile) filePriority(file int) p2p.Priority {
+	if file >= len(torr.FilePriorities) {
+		return p2p.PriorityNormal
+	}
+	return torr.FilePriorities[file]
+}
+
+//文件优先级换算成piece优先级，跨文件边界的piece取所在文件里最高的，只要有一个文件需要就下载
+func (torr *TorrentFile) piecePriorities() []p2p.Priority {
+	if torr.FilePriorities == nil {
+		return nil
+	}
+
+	priorities := make([]p2p.Priority, len(torr.PieceHashes))
+	for index := range priorities {
+		priorities[index] = p2p.PrioritySkip
+	}
+
+	begin := 0
+	for i, f := range torr.Files {
+		end := begin + f.Length
+		if f.Length > 0 {
+			for index := begin / torr.PieceLength; index <= (end-1)/torr.PieceLength; index++ {
+				if torr.filePriority(i) > priorities[index] {
+					priorities[index] = torr.filePriority(i)
+				}
+			}
+		}
+		begin = end
+	}
+	return priorities
+}
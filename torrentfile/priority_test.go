@@ -0,0 +1,61 @@
+package torrentfile
+
+import (
+	"testing"
+
+	"github.com/bingnoi/bittorrent/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func priorityTorrent(pieceLength int, lengths ...int) *TorrentFile {
+	torr := &TorrentFile{PieceLength: pieceLength, multiFile: true}
+	for _, length := range lengths {
+		torr.Files = append(torr.Files, File{Length: length})
+		torr.Length += length
+	}
+	torr.PieceHashes = make([][20]byte, (torr.Length+pieceLength-1)/pieceLength)
+	return torr
+}
+
+func TestPiecePriorities(t *testing.T) {
+	skip, normal, high := p2p.PrioritySkip, p2p.PriorityNormal, p2p.PriorityHigh
+	tests := []struct {
+		name    string
+		lengths []int
+		files   []p2p.Priority
+		want    []p2p.Priority
+	}{
+		//[0,15) [15,20) 空文件 [20,40)，piece长度10
+		{"boundary piece shared", []int{15, 5, 0, 20}, []p2p.Priority{skip, normal, skip, skip}, []p2p.Priority{skip, normal, skip, skip}},
+		{"highest file wins", []int{15, 5, 0, 20}, []p2p.Priority{high, skip, normal, normal}, []p2p.Priority{high, high, normal, normal}},
+		{"exact boundary", []int{10, 10}, []p2p.Priority{skip, normal}, []p2p.Priority{skip, normal}},
+		{"empty file selected", []int{10, 0, 10}, []p2p.Priority{skip, normal, skip}, []p2p.Priority{skip, skip}},
+		{"short last piece", []int{10, 5}, []p2p.Priority{skip, high}, []p2p.Priority{skip, high}},
+	}
+	for _, tt := range tests {
+		torr := priorityTorrent(10, tt.lengths...)
+		torr.FilePriorities = tt.files
+		assert.Equal(t, tt.want, torr.piecePriorities(), tt.name)
+	}
+
+	//没有设置优先级时全部下载
+	assert.Nil(t, priorityTorrent(10, 15, 5).piecePriorities())
+}
+
+func TestSelectFiles(t *testing.T) {
+	torr := priorityTorrent(10, 15, 5, 20)
+	assert.Nil(t, torr.SelectFiles([]int{0, 2}))
+	assert.Equal(t, []p2p.Priority{p2p.PriorityNormal, p2p.PrioritySkip, p2p.PriorityNormal}, torr.FilePriorities)
+
+	//选中之后还可以单独调高优先级
+	assert.Nil(t, torr.SetFilePriority(2, p2p.PriorityHigh))
+	assert.Equal(t, []p2p.Priority{p2p.PriorityNormal, p2p.PrioritySkip, p2p.PriorityHigh}, torr.FilePriorities)
+
+	//重新选择时之前跳过的文件恢复下载，已经设置的优先级不变
+	assert.Nil(t, torr.SelectFiles([]int{1, 2}))
+	assert.Equal(t, []p2p.Priority{p2p.PrioritySkip, p2p.PriorityNormal, p2p.PriorityHigh}, torr.FilePriorities)
+
+	assert.NotNil(t, torr.SelectFiles([]int{3}))
+	assert.NotNil(t, torr.SelectFiles([]int{-1}))
+	assert.NotNil(t, torr.SetFilePriority(3, p2p.PriorityHigh))
+}
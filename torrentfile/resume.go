@@ -0,0 +1,146 @@
+package torrentfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/bingnoi/bittorrent/p2p"
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+//续传文件写入的间隔
+const resumeInterval = 30 * time.Second
+
+//保存在输出文件旁边的续传状态
+type bencodeResume struct {
+	InfoHash   string              `bencode:"info hash"`
+	Bitfield   string              `bencode:"bitfield"`
+	Files      []bencodeResumeFile `bencode:"files"`
+	Peers      string              `bencode:"peers"`
+	Peers6     string              `bencode:"peers6"`
+	Uploaded   int64               `bencode:"uploaded"`
+	Downloaded int64               `bencode:"downloaded"`
+}
+
+type bencodeResumeFile struct {
+	Size  int64 `bencode:"size"`
+	Mtime int64 `bencode:"mtime"`
+	//保存时这个文件是否被跳过，跳过的文件边界piece的数据在.part文件里
+	Skip int `bencode:"skip,omitempty"`
+}
+
+//续传文件的位置，多文件torrent放在根目录旁边
+func resumePath(root string) string {
+	return root + ".resume"
+}
+
+//记录当前下载状态，先写临时文件再改名，避免写到一半被打断
+func (torr *TorrentFile) saveResume(root string, torrent *p2p.Torrent) error {
+	stats := torrent.Stats()
+	res := bencodeResume{
+		InfoHash:   string(torr.InfoHash[:]),
+		Bitfield:   string(stats.Bitfield),
+		Peers:      string(peers.Marshal(stats.Peers)),
+		Peers6:     string(peers.Marshal6(stats.Peers)),
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+	}
+
+	for i, f := range torr.Files {
+		skip := 0
+		if torr.filePriority(i) == p2p.PrioritySkip {
+			skip = 1
+		}
+		stat, err := os.Stat(torr.filePath(root, f))
+		//跳过的文件没有创建，大小记为-1
+		if os.IsNotExist(err) && skip == 1 {
+			res.Files = append(res.Files, bencodeResumeFile{Size: -1, Skip: skip})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		res.Files = append(res.Files, bencodeResumeFile{
+			Size:  stat.Size(),
+			Mtime: stat.ModTime().UnixNano(),
+			Skip:  skip,
+		})
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, res)
+	if err != nil {
+		return err
+	}
+
+	tmp := resumePath(root) + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, resumePath(root))
+}
+
+//读取续传文件，只有info hash、选择的文件和所有文件的大小、修改时间都对得上才信任它
+func (torr *TorrentFile) loadResume(root string) (*bencodeResume, bool) {
+	file, err := os.Open(resumePath(root))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	res := bencodeResume{}
+	err = bencode.Unmarshal(file, &res)
+	if err != nil {
+		log.Println("Resume file broken, recheck all pieces:", err)
+		return nil, false
+	}
+
+	if res.InfoHash != string(torr.InfoHash[:]) {
+		log.Println("Resume file belongs to another torrent, recheck all pieces")
+		return nil, false
+	}
+	if len(res.Bitfield) != len(bitfield.New(len(torr.PieceHashes))) || len(res.Files) != len(torr.Files) {
+		log.Println("Resume file does not match torrent, recheck all pieces")
+		return nil, false
+	}
+
+	for i, f := range torr.Files {
+		//选择的文件变了，边界piece的数据可能在另一个地方，bitfield不能再信任
+		if (res.Files[i].Skip == 1) != (torr.filePriority(i) == p2p.PrioritySkip) {
+			log.Println("File selection changed since last run, recheck all pieces")
+			return nil, false
+		}
+		stat, err := os.Stat(torr.filePath(root, f))
+		if os.IsNotExist(err) && res.Files[i].Size == -1 {
+			continue
+		}
+		if err != nil || stat.Size() != res.Files[i].Size || stat.ModTime().UnixNano() != res.Files[i].Mtime {
+			log.Println("Files changed since last run, recheck all pieces")
+			return nil, false
+		}
+	}
+	return &res, true
+}
+
+//下载过程中定期保存续传文件，直到stop被关闭
+func (torr *TorrentFile) saveResumeLoop(root string, torrent *p2p.Torrent, stop chan struct{}) {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := torr.saveResume(root, torrent)
+			if err != nil {
+				log.Println("Save resume file failed:", err)
+			}
+		}
+	}
+}
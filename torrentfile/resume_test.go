@@ -0,0 +1,99 @@
+package torrentfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/bitfield"
+	"github.com/bingnoi/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//按照torr当前选择的文件保存一次续传文件，bitfield里所有piece都有
+func saveFullResume(t *testing.T, torr *TorrentFile, root string) {
+	torrent := torr.newTorrent([20]byte{}, storage.NewMemoryStorage(torr.Length, torr.PieceLength))
+	bf := bitfield.New(len(torr.PieceHashes))
+	for index := range torr.PieceHashes {
+		bf.SetPiece(index)
+	}
+	torrent.SetBitfield(bf)
+	require.Nil(t, torr.saveResume(root, torrent))
+}
+
+func TestResumeFileSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	torr, src, _ := createTorrent(t, dir, []string{"a", "b", "c"}, []int{40000, 30000, 20000}, 32768)
+
+	saveFullResume(t, &torr, src)
+	_, ok := torr.loadResume(src)
+	assert.True(t, ok)
+
+	//下载过的文件改成跳过，边界piece要从.part文件读，不能信任原来的bitfield
+	require.Nil(t, torr.SelectFiles([]int{0, 2}))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+
+	//跳过的文件没有创建
+	require.Nil(t, os.Remove(filepath.Join(src, "b")))
+	saveFullResume(t, &torr, src)
+	_, ok = torr.loadResume(src)
+	assert.True(t, ok)
+
+	//之前跳过的文件重新选中，边界piece的数据还在.part文件里
+	require.Nil(t, torr.SelectFiles([]int{0, 1, 2}))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+}
+
+func TestResumeChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	torr, src, _ := createTorrent(t, dir, []string{"a", "b"}, []int{40000, 30000}, 32768)
+	a := filepath.Join(src, "a")
+
+	saveFullResume(t, &torr, src)
+	saved, ok := torr.loadResume(src)
+	require.True(t, ok)
+	assert.Equal(t, string(torr.InfoHash[:]), saved.InfoHash)
+
+	//别的torrent的续传文件
+	other := torr
+	other.InfoHash[0] ^= 0xff
+	_, ok = other.loadResume(src)
+	assert.False(t, ok)
+
+	//修改时间变了
+	stat, err := os.Stat(a)
+	require.Nil(t, err)
+	later := stat.ModTime().Add(time.Hour)
+	require.Nil(t, os.Chtimes(a, later, later))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+
+	//大小变了，修改时间和保存时一样
+	saveFullResume(t, &torr, src)
+	_, ok = torr.loadResume(src)
+	require.True(t, ok)
+	require.Nil(t, os.Truncate(a, 1000))
+	require.Nil(t, os.Chtimes(a, later, later))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+
+	//文件被删掉
+	saveFullResume(t, &torr, src)
+	require.Nil(t, os.Remove(a))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+
+	//续传文件损坏
+	require.Nil(t, ioutil.WriteFile(resumePath(src), []byte("d4:info"), 0644))
+	_, ok = torr.loadResume(src)
+	assert.False(t, ok)
+}
@@ -0,0 +1,156 @@
+package torrentfile
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+//udp tracker一次scrape最多74个info hash
+const maxUDPScrape = 74
+
+//一个info hash在某个tracker上的情况
+type ScrapeResult struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+//按照约定把announce地址最后一段的announce换成scrape，不符合约定的tracker不支持scrape
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "udp" {
+		return announce, nil
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s does not support scrape", announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	return u.String(), nil
+}
+
+//向一个tracker查询多个info hash，tracker没有返回的info hash不会出现在结果里
+func Scrape(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(announce, infoHashes)
+	case "udp":
+		return scrapeUDP(u.Host, infoHashes)
+	default:
+		return nil, fmt.Errorf("Tracker scheme %q not supported", u.Scheme)
+	}
+}
+
+func scrapeHTTP(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrape, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(scrape)
+	if err != nil {
+		return nil, err
+	}
+
+	//info_hash参数可以重复多次
+	params := base.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	base.RawQuery = params.Encode()
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := bencode.Decode(resp.Body)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Tracker %s returned %s", scrape, resp.Status)
+		}
+		return nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Tracker %s scrape response is not a dictionary", scrape)
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{URL: scrape, Reason: reason}
+	}
+
+	files, _ := dict["files"].(map[string]interface{})
+	results := make(map[[20]byte]ScrapeResult)
+	for key, v := range files {
+		stats, ok := v.(map[string]interface{})
+		if !ok || len(key) != 20 {
+			continue
+		}
+		var h [20]byte
+		copy(h[:], key)
+		results[h] = ScrapeResult{
+			Complete:   bencodeInt(stats["complete"]),
+			Downloaded: bencodeInt(stats["downloaded"]),
+			Incomplete: bencodeInt(stats["incomplete"]),
+		}
+	}
+	return results, nil
+}
+
+//bencode.Decode出来的整数是int64
+func bencodeInt(v interface{}) int {
+	n, _ := v.(int64)
+	return int(n)
+}
+
+func scrapeUDP(addr string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	t := getUDPTracker(addr)
+	results := make(map[[20]byte]ScrapeResult)
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxUDPScrape {
+			batch = batch[:maxUDPScrape]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		res, err := t.scrape(batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range batch {
+			results[h] = ScrapeResult{
+				Complete:   res[i].Seeders,
+				Downloaded: res[i].Completed,
+				Incomplete: res[i].Leechers,
+			}
+		}
+	}
+	return results, nil
+}
+
+//所有tracker地址，按照announce-list的顺序展开
+func (torr *TorrentFile) Trackers() []string {
+	tiersMu.Lock()
+	defer tiersMu.Unlock()
+
+	var list []string
+	for _, tier := range torr.trackerTiers() {
+		list = append(list, tier...)
+	}
+	return list
+}
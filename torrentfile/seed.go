@@ -0,0 +1,142 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bingnoi/bittorrent/p2p"
+	"github.com/bingnoi/bittorrent/storage"
+)
+
+//做种的停止条件，两个都为0表示一直做种直到收到信号
+type SeedOptions struct {
+	//上传量达到文件大小的多少倍后停止
+	Ratio float64
+	//最多做种多长时间
+	Time time.Duration
+}
+
+//检查做种条件的间隔
+const seedCheckInterval = 10 * time.Second
+
+//收到SIGINT/SIGTERM时中断torrent的下载并关闭返回的channel，调用stop之后不再监听
+func watchSignals(torrent *p2p.Torrent) (<-chan struct{}, func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	interrupted := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case s := <-sig:
+			log.Println("Got signal", s, "stopping")
+			close(interrupted)
+			torrent.Interrupt()
+		case <-done:
+		}
+	}()
+	return interrupted, func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
+
+//下载完成后继续做种，直到达到分享率、做种时间或者interrupted被关闭
+func (torr *TorrentFile) seed(torrent *p2p.Torrent, opts *SeedOptions, interrupted <-chan struct{}) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(seedCheckInterval)
+		defer ticker.Stop()
+		start := time.Now()
+		startUploaded := torrent.Stats().Uploaded
+
+		for {
+			select {
+			case <-interrupted:
+				close(done)
+				return
+			case <-ticker.C:
+			}
+
+			uploaded := torrent.Stats().Uploaded
+			ratio := float64(uploaded) / float64(torr.Length)
+			log.Printf("Seeding %s, uploaded %d bytes this session, ratio %0.2f\n", time.Since(start).Round(time.Second), uploaded-startUploaded, ratio)
+			if opts.Ratio > 0 && ratio >= opts.Ratio {
+				log.Println("Seed ratio reached, stop seeding")
+				close(done)
+				return
+			}
+			if opts.Time > 0 && time.Since(start) >= opts.Time {
+				log.Println("Seed time reached, stop seeding")
+				close(done)
+				return
+			}
+		}
+	}()
+
+	torrent.Seed(done)
+}
+
+//只做种不下载：先校验path下已有的数据，全部正确后以left=0向tracker announce并给其他peer上传
+func (torr *TorrentFile) Seed(path string, opts SeedOptions) error {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	if err != nil {
+		return err
+	}
+
+	//只读打开，做种时不会修改已有的文件
+	st, err := storage.OpenFileStorage(torr.storageFiles(path), torr.PieceLength)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	torrent := torr.newTorrent(peerID, st)
+	defer torrent.Close()
+	bf, err := torrent.Recheck()
+	if err != nil {
+		return err
+	}
+	torrent.SetBitfield(bf)
+	left := torrent.Stats().Left
+	if left > 0 {
+		return fmt.Errorf("Data in %s is incomplete, %d bytes missing or corrupt", path, left)
+	}
+
+	//做种必须能让别人连进来
+	ln, err := p2p.Listen(Port)
+	if err != nil {
+		return err
+	}
+	ln.Register(torrent)
+	defer ln.Close()
+
+	//tracker不可用时只等别人连进来，之后由announce循环重试
+	wait := trackerRetry
+	resp, err := torr.requestPeers(progressRequest(torrent, peerID, EventStarted), torrent.AddPeers)
+	if err != nil {
+		log.Println("Tracker failed, wait for incoming peers:", err)
+	} else {
+		log.Printf("Swarm has %d seeders, %d leechers\n", resp.Complete, resp.Incomplete)
+		torrent.AddPeers(resp.Peers)
+		wait = resp.wait()
+	}
+
+	interrupted, stopSignals := watchSignals(torrent)
+	defer stopSignals()
+
+	stop := make(chan struct{})
+	go torr.announceLoop(torrent, peerID, wait, stop)
+	torr.seed(torrent, &opts, interrupted)
+	close(stop)
+	torr.announceEvent(torrent, peerID, EventStopped)
+
+	stats := torrent.Stats()
+	log.Printf("Seeding done, uploaded %d bytes\n", stats.Uploaded)
+	return nil
+}
@@ -6,19 +6,21 @@ and dispatch the function to various module
 package torrentfile
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"time"
+	"path/filepath"
+	"strings"
 
+	"github.com/bingnoi/bittorrent/bitfield"
 	"github.com/bingnoi/bittorrent/p2p"
 	"github.com/bingnoi/bittorrent/peers"
+	"github.com/bingnoi/bittorrent/storage"
 	"github.com/jackpal/bencode-go"
 )
 
@@ -28,33 +30,62 @@ const Port uint16 = 6881
 // define a decoded torrent file
 
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce string
+	//BEP 12的多级tracker，每一级内部已经打乱顺序
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	//info字典的原始字节，InfoHash就是它的SHA-1，给peer提供metadata时直接发送
+	RawInfo []byte
+	//按piece编号顺序下载，方便边下边播
+	Sequential bool
+	//每个文件的优先级，nil表示全部下载
+	FilePriorities []p2p.Priority
+	multiFile      bool
+	//magnet链接里带的或者获取metadata时用过的peer
+	extraPeers []peers.Peer
+}
+
+//多文件torrent中的单个文件，Path是相对于根目录的各级路径
+type File struct {
+	Length int
+	Path   []string
 }
 
 //define a bencode
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Private     int           `bencode:"private,omitempty"`
 }
 
-type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
-type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+type bencodeTorrent struct {
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
 func (torr*TorrentFile) DownloadToFile(path string) error {
+	return torr.DownloadAndSeed(path, nil)
+}
+
+//下载完成后按照opts继续做种，opts为nil时下载完就退出
+func (torr *TorrentFile) DownloadAndSeed(path string, opts *SeedOptions) error {
 	var peerID [20]byte
 	
 	_, err := rand.Read(peerID[:])
@@ -62,45 +93,168 @@ func (torr*TorrentFile) DownloadToFile(path string) error {
 		return err
 	}
 
-	//读取PeerId,并进行处理
-	peers, err := torr.requestPeers(peerID, Port)
+	//已经有输出文件时进入续传模式，续传文件可信就不用重新校验
+	resume := torr.outputExists(path)
+	var saved *bencodeResume
+	if resume {
+		saved, _ = torr.loadResume(path)
+	}
+
+	//预分配输出文件，piece下载完就写进去
+	st, err := storage.NewFileStorage(torr.storageFiles(path), torr.PieceLength)
 	if err != nil {
 		return err
 	}
+	defer st.Close()
+
+	//生成p2p对象，返回之前断开所有连接，之后st才能关闭
+	torrent := torr.newTorrent(peerID, st)
+	defer torrent.Close()
+
+	//下载过程中收到Ctrl-C也要发送stopped并保存续传文件，之后做种时同样生效
+	interrupted, stopSignals := watchSignals(torrent)
+	defer stopSignals()
+
+	//续传：优先使用续传文件，否则重新校验已有数据，只下载缺少的piece
+	var knownPeers []peers.Peer
+	if saved != nil {
+		log.Println("Fast resume from", resumePath(path))
+		torrent.SetBitfield(bitfield.Bitfield(saved.Bitfield))
+		torrent.Downloaded = saved.Downloaded
+		torrent.Uploaded = saved.Uploaded
+		knownPeers, _ = peers.Unmarshal([]byte(saved.Peers))
+		knownPeers6, _ := peers.Unmarshal6([]byte(saved.Peers6))
+		knownPeers = mergePeers(knownPeers, knownPeers6)
+	} else if resume {
+		bf, err := torrent.Recheck()
+		if err != nil {
+			return err
+		}
+		torrent.SetBitfield(bf)
+	}
+	complete := resume && torrent.Done()
+	if complete && opts == nil {
+		log.Println("All pieces already on disk, nothing to download")
+		return torr.saveResume(path, torrent)
+	}
+
+	//读取PeerId,并进行处理，tracker不可用时先用已知的peer，之后由announce循环重试
+	wait := trackerRetry
+	var trackerPeers []peers.Peer
+	resp, err := torr.requestPeers(progressRequest(torrent, peerID, EventStarted), torrent.AddPeers)
+	if err != nil {
+		if len(knownPeers) == 0 && len(torr.extraPeers) == 0 && !complete {
+			return err
+		}
+		log.Println("Tracker failed, use peers we already know:", err)
+	} else {
+		log.Printf("Swarm has %d seeders, %d leechers\n", resp.Complete, resp.Incomplete)
+		trackerPeers = resp.Peers
+		wait = resp.wait()
+	}
+	//不直接赋值，慢的tracker之后通过AddPeers给出的peer不会被覆盖
+	torrent.AddPeers(mergePeers(trackerPeers, knownPeers, torr.extraPeers))
+
+	//监听announce出去的端口，让其他peer可以主动连接我们
+	ln, lnErr := p2p.Listen(Port)
+	if lnErr != nil {
+		log.Println("Listen failed, only outgoing connections:", lnErr)
+	} else {
+		ln.Register(torrent)
+		defer ln.Close()
+	}
+
+	//开始下载，同时定期保存续传文件、重新announce，做种期间announce继续
+	stop := make(chan struct{})
+	go torr.saveResumeLoop(path, torrent, stop)
+	go torr.announceLoop(torrent, peerID, wait, stop)
+	var downloadErr error
+	if !complete {
+		downloadErr = torrent.Download()
+		//跳过了一部分文件时不算完成
+		if downloadErr == nil && torrent.Complete() {
+			torr.announceEvent(torrent, peerID, EventCompleted)
+		}
+	}
+	if downloadErr == nil && opts != nil {
+		torr.seed(torrent, opts, interrupted)
+	}
+	close(stop)
+	torr.announceEvent(torrent, peerID, EventStopped)
+
+	saveErr := torr.saveResume(path, torrent)
+	if downloadErr != nil {
+		return downloadErr
+	}
+	if saveErr != nil {
+		log.Println("Save resume file failed:", saveErr)
+	}
+
+	log.Println("Download Successfully! Wish you have a good day!")
+	return nil
+}
 
-	//生成p2p对象
-	torrent := p2p.Torrent{
-		Peers:       peers,
+//按照torrent信息生成p2p对象，下载和只做种共用
+func (torr *TorrentFile) newTorrent(peerID [20]byte, st storage.Storage) *p2p.Torrent {
+	return &p2p.Torrent{
 		PeerID:      peerID,
 		InfoHash:    torr.InfoHash,
 		PieceHashes: torr.PieceHashes,
 		PieceLength: torr.PieceLength,
 		Length:      torr.Length,
 		Name:        torr.Name,
+		Storage:     st,
+		Sequential:  torr.Sequential,
+		Priorities:  torr.piecePriorities(),
 	}
+}
 
-	//开始下载
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
+//合并两组peer，去掉重复的地址
+func mergePeers(lists ...[]peers.Peer) []peers.Peer {
+	seen := make(map[string]bool)
+	var merged []peers.Peer
+	for _, list := range lists {
+		for _, p := range list {
+			if seen[p.String()] {
+				continue
+			}
+			seen[p.String()] = true
+			merged = append(merged, p)
+		}
 	}
+	return merged
+}
 
-	//创建文件入口
-	outFile, err := os.Create(path)
-	if err != nil {
-		return err
+//单文件时path就是输出文件，多文件时path是根目录
+func (torr *TorrentFile) filePath(root string, f File) string {
+	if !torr.multiFile {
+		return root
 	}
-	
-	defer outFile.Close()
+	return filepath.Join(append([]string{root}, f.Path...)...)
+}
 
-	//写入对应的文件
-	_, err = outFile.Write(buf)
-	if err != nil {
-		return err
+//只要有一个输出文件已经存在就认为是之前中断的下载
+func (torr *TorrentFile) outputExists(root string) bool {
+	for _, f := range torr.Files {
+		_, err := os.Stat(torr.filePath(root, f))
+		if err == nil {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Println("Download Successfully! Wish you have a good day!")
-	return nil
+//输出文件列表，跨越文件边界的piece由storage负责拆分
+func (torr *TorrentFile) storageFiles(root string) []storage.FileInfo {
+	infos := make([]storage.FileInfo, len(torr.Files))
+	for i, f := range torr.Files {
+		infos[i] = storage.FileInfo{
+			Path:   torr.filePath(root, f),
+			Length: f.Length,
+			Skip:   torr.filePriority(i) == p2p.PrioritySkip,
+		}
+	}
+	return infos
 }
 
 //解析torrent文件
@@ -115,25 +269,66 @@ func Open(path string) (TorrentFile, error) {
 
 	fmt.Println(path)
 
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
 	//如果解码成功
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
 
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	return bto.toTorrentFile()
+	//info hash必须用文件里info字典的原始字节计算，重新编码会丢掉不认识的字段
+	raw, err := rawInfo(data)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	return bto.toTorrentFile(raw)
 }
 
-func (info *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *info)
+//找到顶层字典里info对应的那一段原始字节
+func rawInfo(data []byte) ([]byte, error) {
+	br := bytes.NewReader(data)
+	r := bufio.NewReader(br)
+	pos := func() int {
+		return len(data) - br.Len() - r.Buffered()
+	}
+
+	c, err := r.ReadByte()
 	if err != nil {
-		return [20]byte{}, err
+		return nil, err
+	}
+	if c != 'd' {
+		return nil, fmt.Errorf("Error! torrent is not a dictionary")
+	}
+
+	for {
+		next, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if next[0] == 'e' {
+			return nil, fmt.Errorf("Error! torrent has no info dictionary")
+		}
+
+		key, err := bencode.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		begin := pos()
+		_, err = bencode.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			return data[begin:pos()], nil
+		}
 	}
-	hashsum := sha1.Sum(buf.Bytes())
-	return hashsum, nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -152,22 +347,62 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
-func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
+//整理文件列表，单文件torrent也当成只有一个文件处理
+func (i *bencodeInfo) files() ([]File, int, error) {
+	//name是默认的输出文件名或者根目录名，和路径一样不能跳出当前目录
+	if badPathSegment(i.Name) {
+		return nil, 0, fmt.Errorf("Error! torrent has bad name %q", i.Name)
+	}
+	if len(i.Files) == 0 {
+		return []File{{Length: i.Length, Path: []string{i.Name}}}, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	total := 0
+	for idx, f := range i.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("Error! file #%d has length %d", idx, f.Length)
+		}
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("Error! file #%d has empty path", idx)
+		}
+		for _, seg := range f.Path {
+			if badPathSegment(seg) {
+				return nil, 0, fmt.Errorf("Error! file #%d has bad path %q", idx, f.Path)
+			}
+		}
+		files[idx] = File{Length: f.Length, Path: f.Path}
+		total += f.Length
+	}
+	return files, total, nil
+}
+
+//路径里的一段，空的、.和..或者带分隔符的都可能写到输出目录外面
+func badPathSegment(seg string) bool {
+	return seg == "" || seg == "." || seg == ".." || strings.ContainsAny(seg, "/\\")
+}
+
+func (bto *bencodeTorrent) toTorrentFile(raw []byte) (TorrentFile, error) {
+	infoHash := sha1.Sum(raw)
+	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
+	files, length, err := bto.Info.files()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	torr:= TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: shuffleTiers(bto.AnnounceList),
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Files:        files,
+		RawInfo:      raw,
+		multiFile:    len(bto.Info.Files) > 0,
 	}
 	log.Println("Announce...OK")
 	log.Println("InfoHash...OK")
@@ -175,53 +410,7 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	log.Println("PieceLength...OK")  
 	log.Println("Length...OK")       
 	log.Println("Name...OK")     
+	log.Println("Files...OK")
 	log.Println("Parse Successfully:)")    
 	return torr , nil
 }
-
-func (torr *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(torr.Announce)
-	if err != nil {
-		return "", err
-	}
-
-	//生成url参数
-	params := url.Values{
-		"info_hash":  []string{string(torr.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(Port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(torr.Length)},
-	}
-	base.RawQuery = params.Encode()
-	return base.String(), nil
-}
-
-func (torr*TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	//构建TrackerUrl
-	url, err := torr.buildTrackerURL(peerID, port)
-
-	if err != nil {
-		return nil, err
-	}
-
-	//设置超时时间与事件
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
-	if err != nil {
-		return nil, err
-	}
-
-	//返回了解析值
-	return peers.Unmarshal([]byte(trackerResp.Peers))
-	
-}
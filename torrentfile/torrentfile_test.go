@@ -0,0 +1,59 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesBadPath(t *testing.T) {
+	tests := []struct {
+		name string
+		info bencodeInfo
+		ok   bool
+	}{
+		{"single", bencodeInfo{Name: "a.iso", Length: 10}, true},
+		{"multi", bencodeInfo{Name: "dir", Files: []bencodeFile{{10, []string{"sub", "a"}}}}, true},
+		{"name parent", bencodeInfo{Name: "..", Length: 10}, false},
+		{"name traversal", bencodeInfo{Name: "../../x", Length: 10}, false},
+		{"name absolute", bencodeInfo{Name: "/etc/x", Length: 10}, false},
+		{"name empty", bencodeInfo{Name: "", Files: []bencodeFile{{10, []string{"a"}}}}, false},
+		{"name backslash", bencodeInfo{Name: "..\\x", Length: 10}, false},
+		{"path parent", bencodeInfo{Name: "dir", Files: []bencodeFile{{10, []string{"..", "a"}}}}, false},
+	}
+	for _, tt := range tests {
+		_, _, err := tt.info.files()
+		assert.Equal(t, tt.ok, err == nil, tt.name)
+	}
+}
+
+func TestOpenRawInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rawinfo")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	//info字典里有不认识的字段，key也没有排序，重新编码会得到不同的字节
+	pieces := strings.Repeat("\x01", 20)
+	info := "d4:name5:a.iso6:lengthi10e12:piece lengthi16384e6:pieces20:" + pieces + "7:x-extra5:helloe"
+	data := "d8:announce26:http://tracker.example/ann4:info" + info + "7:comment2:hie"
+	path := filepath.Join(dir, "raw.torrent")
+	require.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+	torr, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, []byte(info), torr.RawInfo)
+	assert.Equal(t, sha1.Sum([]byte(info)), torr.InfoHash)
+	assert.Equal(t, "a.iso", torr.Name)
+	assert.Equal(t, 10, torr.Length)
+
+	_, err = rawInfo([]byte("d8:announce3:abce"))
+	assert.NotNil(t, err)
+	_, err = rawInfo([]byte("l4:infoe"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,468 @@
+package torrentfile
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+//announce时带的事件，EventNone表示普通的定期announce
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+//tracker没有给interval时默认的重新announce间隔
+const defaultInterval = 30 * time.Minute
+
+//每次请求希望tracker返回的peer数量
+const defaultNumWant = 50
+
+type bencodeTrackerResp struct {
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
+}
+
+//一次announce需要上报的内容，Key和TrackerID为空时自动填写
+type AnnounceRequest struct {
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	Key        uint32
+	NumWant    int
+	TrackerID  string
+}
+
+//announce的结果，多个tier同时回应时合并在一起
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	Complete    int
+	Incomplete  int
+	Warning     string
+	Peers       []peers.Peer
+}
+
+//tracker返回了failure reason，或者udp tracker返回了error
+type TrackerError struct {
+	URL    string
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("Tracker %s failed: %s", e.URL, e.Reason)
+}
+
+//本次运行使用的key，让tracker在我们IP变化后仍能认出我们
+var announceKey = newAnnounceKey()
+
+func newAnnounceKey() uint32 {
+	var buf [4]byte
+	crand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+//tracker给过的tracker id，之后向同一个tracker announce时要带上
+var (
+	trackerIDsMu sync.Mutex
+	trackerIDs   = make(map[string]string)
+)
+
+func trackerIDKey(announce string, infoHash [20]byte) string {
+	return announce + "|" + string(infoHash[:])
+}
+
+func (torr *TorrentFile) trackerID(announce string) string {
+	trackerIDsMu.Lock()
+	defer trackerIDsMu.Unlock()
+	return trackerIDs[trackerIDKey(announce, torr.InfoHash)]
+}
+
+func (torr *TorrentFile) setTrackerID(announce, id string) {
+	if id == "" {
+		return
+	}
+	trackerIDsMu.Lock()
+	trackerIDs[trackerIDKey(announce, torr.InfoHash)] = id
+	trackerIDsMu.Unlock()
+}
+
+//补上请求里没有填的key、numwant和tracker id
+func (torr *TorrentFile) fillRequest(announce string, req *AnnounceRequest) AnnounceRequest {
+	r := *req
+	if r.Key == 0 {
+		r.Key = announceKey
+	}
+	if r.NumWant == 0 {
+		r.NumWant = defaultNumWant
+	}
+	if r.TrackerID == "" {
+		r.TrackerID = torr.trackerID(announce)
+	}
+	return r
+}
+
+func (torr *TorrentFile) buildTrackerURL(announce string, req *AnnounceRequest) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	//生成url参数
+	params := url.Values{
+		"info_hash":  []string{string(torr.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatInt(req.Left, 10)},
+		"key":        []string{strconv.FormatUint(uint64(req.Key), 16)},
+		"numwant":    []string{strconv.Itoa(req.NumWant)},
+	}
+	if req.Event != EventNone {
+		params.Set("event", req.Event)
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+//向单个HTTP tracker请求peer
+func (torr *TorrentFile) announceHTTP(announce string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	//构建TrackerUrl
+	url, err := torr.buildTrackerURL(announce, req)
+	if err != nil {
+		return nil, err
+	}
+
+	//设置超时时间与事件
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	trackerResp := bencodeTrackerResp{}
+	err = bencode.Unmarshal(bytes.NewReader(body), &trackerResp)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Tracker %s returned %s", announce, resp.Status)
+		}
+		return nil, err
+	}
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerError{URL: announce, Reason: trackerResp.FailureReason}
+	}
+
+	//返回了解析值
+	list, err := parsePeers(body)
+	if err != nil {
+		return nil, err
+	}
+	return &AnnounceResponse{
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		TrackerID:   trackerResp.TrackerID,
+		Complete:    trackerResp.Complete,
+		Incomplete:  trackerResp.Incomplete,
+		Warning:     trackerResp.WarningMessage,
+		Peers:       list,
+	}, nil
+}
+
+//peers可能是compact字符串，也可能是字典列表；peers6是compact的IPv6列表，全部合并
+func parsePeers(body []byte) ([]peers.Peer, error) {
+	data, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Tracker response is not a dictionary")
+	}
+
+	var list []peers.Peer
+	switch v := dict["peers"].(type) {
+	case string:
+		list, err = peers.Unmarshal([]byte(v))
+	case []interface{}:
+		list, err = peers.UnmarshalDicts(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := dict["peers6"].(string); ok {
+		list6, err := peers.Unmarshal6([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+		list = mergePeers(list, list6)
+	}
+	return list, nil
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+//根据announce的scheme选择HTTP或者UDP协议，并记录tracker id和警告
+func (torr *TorrentFile) announce(announce string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	r := torr.fillRequest(announce, req)
+	var resp *AnnounceResponse
+	switch u.Scheme {
+	case "http", "https":
+		resp, err = torr.announceHTTP(announce, &r)
+	case "udp":
+		resp, err = torr.announceUDP(announce, &r)
+	default:
+		return nil, fmt.Errorf("Tracker scheme %q not supported", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Warning != "" {
+		log.Println("Tracker", announce, "warning:", resp.Warning)
+	}
+	torr.setTrackerID(announce, resp.TrackerID)
+	return resp, nil
+}
+
+//BEP 12：每一级内部的顺序在加载时随机打乱
+func shuffleTiers(tiers [][]string) [][]string {
+	shuffled := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		t := make([]string, len(tier))
+		copy(t, tier)
+		rand.Shuffle(len(t), func(i, j int) {
+			t[i], t[j] = t[j], t[i]
+		})
+		shuffled = append(shuffled, t)
+	}
+	return shuffled
+}
+
+//有announce-list时忽略announce，否则announce单独作为一级
+func (torr *TorrentFile) trackerTiers() [][]string {
+	if len(torr.AnnounceList) > 0 {
+		return torr.AnnounceList
+	}
+	if torr.Announce == "" {
+		return nil
+	}
+	return [][]string{{torr.Announce}}
+}
+
+//announce循环和事件announce可能同时调整同一级的顺序
+var tiersMu sync.Mutex
+
+//向一级tracker请求peer：按顺序尝试，成功的那个挪到这一级的最前面
+func (torr *TorrentFile) announceTier(tier []string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	tiersMu.Lock()
+	order := append([]string(nil), tier...)
+	tiersMu.Unlock()
+
+	var errs []error
+	for _, announce := range order {
+		resp, err := torr.announce(announce, req)
+		if err != nil {
+			log.Println("Tracker", announce, "failed:", err)
+			errs = append(errs, err)
+			continue
+		}
+		promote(tier, announce)
+		return resp, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("Empty tracker tier")
+	}
+	return nil, trackerError(errs)
+}
+
+func promote(tier []string, announce string) {
+	tiersMu.Lock()
+	defer tiersMu.Unlock()
+	for i, a := range tier {
+		if a == announce {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = announce
+			return
+		}
+	}
+}
+
+//一次announce最多等多久，超过之后还没有回应的tier在后台继续，给出的peer交给late
+const announceTimeout = time.Minute
+
+//一级tracker的announce结果
+type tierResult struct {
+	resp *AnnounceResponse
+	err  error
+}
+
+//所有级别并行请求，有tier给出peer就返回，同时已经回应的tier一起合并；
+//返回之后才回应的tier的peer交给late，late为nil时丢掉
+func (torr *TorrentFile) requestPeers(req *AnnounceRequest, late func([]peers.Peer)) (*AnnounceResponse, error) {
+	tiers := torr.trackerTiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("No tracker in torrent")
+	}
+
+	//能放下所有结果，返回之后慢的tier写结果也不会阻塞
+	results := make(chan tierResult, len(tiers))
+	for _, tier := range tiers {
+		go func(tier []string) {
+			resp, err := torr.announceTier(tier, req)
+			results <- tierResult{resp, err}
+		}(tier)
+	}
+
+	timer := time.NewTimer(announceTimeout)
+	defer timer.Stop()
+	var merged *AnnounceResponse
+	var errs []error
+	pending := len(tiers)
+	timeout := false
+	//第一个回应的tier没有peer时继续等其他tier，避免快的tracker盖住慢的
+	for pending > 0 && !timeout && (merged == nil || len(merged.Peers) == 0) {
+		select {
+		case res := <-results:
+			pending--
+			merged, errs = collectResult(merged, errs, res)
+		case <-timer.C:
+			timeout = true
+		}
+	}
+	//已经到了的其他tier一起合并
+	for drained := false; pending > 0 && !drained; {
+		select {
+		case res := <-results:
+			pending--
+			merged, errs = collectResult(merged, errs, res)
+		default:
+			drained = true
+		}
+	}
+	if pending > 0 && late != nil {
+		go lateResults(results, pending, late)
+	}
+
+	if merged != nil {
+		return merged, nil
+	}
+	if timeout {
+		return nil, fmt.Errorf("No tracker answered within %s", announceTimeout)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("No tracker answered")
+	}
+	return nil, trackerError(errs)
+}
+
+func collectResult(merged *AnnounceResponse, errs []error, res tierResult) (*AnnounceResponse, []error) {
+	if res.resp != nil {
+		return mergeResponse(merged, res.resp), errs
+	}
+	if res.err != nil {
+		errs = append(errs, res.err)
+	}
+	return merged, errs
+}
+
+//等剩下的tier回应，把它们的peer交给late
+func lateResults(results chan tierResult, pending int, late func([]peers.Peer)) {
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.resp != nil && len(res.resp.Peers) > 0 {
+			late(res.resp.Peers)
+		}
+	}
+}
+
+//都失败时优先返回tracker给出的失败原因，连接错误之类的放在后面
+func trackerError(errs []error) error {
+	for _, err := range errs {
+		if _, ok := err.(*TrackerError); ok {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+//合并两个tier的响应：interval取最小值，做种/下载人数取最大值，merged为nil时直接复制
+func mergeResponse(merged *AnnounceResponse, resp *AnnounceResponse) *AnnounceResponse {
+	if merged == nil {
+		copied := *resp
+		return &copied
+	}
+	if resp.Interval > 0 && (merged.Interval == 0 || resp.Interval < merged.Interval) {
+		merged.Interval = resp.Interval
+	}
+	if resp.MinInterval > merged.MinInterval {
+		merged.MinInterval = resp.MinInterval
+	}
+	if resp.Complete > merged.Complete {
+		merged.Complete = resp.Complete
+	}
+	if resp.Incomplete > merged.Incomplete {
+		merged.Incomplete = resp.Incomplete
+	}
+	if resp.Warning != "" {
+		merged.Warning = resp.Warning
+	}
+	merged.Peers = mergePeers(merged.Peers, resp.Peers)
+	return merged
+}
+
+//下一次announce之前要等多久，不能短于min interval
+func (resp *AnnounceResponse) wait() time.Duration {
+	wait := resp.Interval
+	if wait <= 0 {
+		wait = defaultInterval
+	}
+	if wait < resp.MinInterval {
+		wait = resp.MinInterval
+	}
+	return wait
+}
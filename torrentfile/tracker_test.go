@@ -0,0 +1,114 @@
+package torrentfile
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//返回一个固定peer的HTTP tracker
+func newHTTPTracker(body string, release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if release != nil {
+			<-release
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestRequestPeersFirstTier(t *testing.T) {
+	fast := newHTTPTracker("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e", nil)
+	defer fast.Close()
+	release := make(chan struct{})
+	slow := newHTTPTracker("d8:intervali60e5:peers6:\x7f\x00\x00\x02\x1a\xe1e", release)
+	defer slow.Close()
+	defer close(release)
+
+	torr := TorrentFile{AnnounceList: [][]string{{slow.URL + "/announce"}, {fast.URL + "/announce"}}}
+	start := time.Now()
+	resp, err := torr.requestPeers(&AnnounceRequest{Port: Port}, nil)
+	require.Nil(t, err)
+
+	//慢的tier不影响返回
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 900*time.Second, resp.Interval)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, resp.Peers)
+}
+
+func TestRequestPeersLate(t *testing.T) {
+	fast := newHTTPTracker("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e", nil)
+	defer fast.Close()
+	release := make(chan struct{})
+	slow := newHTTPTracker("d8:intervali60e5:peers6:\x7f\x00\x00\x02\x1a\xe1e", release)
+	defer slow.Close()
+
+	//返回之后才回应的tier，peer交给late
+	late := make(chan []peers.Peer, 1)
+	torr := TorrentFile{AnnounceList: [][]string{{slow.URL + "/announce"}, {fast.URL + "/announce"}}}
+	resp, err := torr.requestPeers(&AnnounceRequest{Port: Port}, func(list []peers.Peer) { late <- list })
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, resp.Peers)
+
+	close(release)
+	select {
+	case list := <-late:
+		assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6881}}, list)
+	case <-time.After(5 * time.Second):
+		t.Fatal("late peers not delivered")
+	}
+}
+
+func TestRequestPeersEmptyFirst(t *testing.T) {
+	empty := newHTTPTracker("d8:intervali900e5:peers0:e", nil)
+	defer empty.Close()
+	release := make(chan struct{})
+	slow := newHTTPTracker("d8:intervali60e5:peers6:\x7f\x00\x00\x02\x1a\xe1e", release)
+	defer slow.Close()
+
+	//先回应的tier没有peer时继续等有peer的tier
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	torr := TorrentFile{AnnounceList: [][]string{{empty.URL + "/announce"}, {slow.URL + "/announce"}}}
+	resp, err := torr.requestPeers(&AnnounceRequest{Port: Port}, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 60*time.Second, resp.Interval)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6881}}, resp.Peers)
+}
+
+func TestRequestPeersAllFail(t *testing.T) {
+	failing := newHTTPTracker("d14:failure reason6:bannede", nil)
+	defer failing.Close()
+	dead := newHTTPTracker("", nil)
+	dead.Close()
+
+	//连不上的tier不能盖住tracker给出的失败原因
+	torr := TorrentFile{AnnounceList: [][]string{{dead.URL + "/announce"}, {failing.URL + "/announce"}}}
+	_, err := torr.requestPeers(&AnnounceRequest{Port: Port}, nil)
+	require.NotNil(t, err)
+	trackerErr, ok := err.(*TrackerError)
+	require.True(t, ok)
+	assert.Equal(t, "banned", trackerErr.Reason)
+}
+
+func TestParsePeers(t *testing.T) {
+	//字典格式的peers加上peers6，域名的peer被跳过
+	body := "d8:intervali900e" +
+		"5:peersld2:ip8:10.0.0.17:peer id20:-GT0001-abcdefghijkl4:porti6881eed2:ip16:peer.example.com4:porti6881eee" +
+		"6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e"
+	list, err := parsePeers([]byte(body))
+	require.Nil(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "10.0.0.1:6881", list[0].String())
+	assert.Equal(t, "[2001:db8::1]:6881", list[1].String())
+
+	_, err = parsePeers([]byte("d5:peers5:abcdee"))
+	assert.NotNil(t, err)
+}
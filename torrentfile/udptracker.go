@@ -0,0 +1,319 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bingnoi/bittorrent/peers"
+)
+
+//BEP 15 UDP tracker协议
+const udpProtocolID uint64 = 0x41727101980
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+//按BEP 15第n次重传等待udpTimeout*2^n，BEP 15最多到n=8，要一个多小时；
+//这里只到n=2，一共15+30+60秒，之后由announce循环重试。connection id的有效期是一分钟
+var (
+	udpTimeout   = 15 * time.Second
+	udpAttempts  = 3
+	udpConnIDTTL = time.Minute
+)
+
+//等待响应超时，可以重传
+var errUDPTimeout = errors.New("Tracker timeout")
+
+//同一个tracker的connection id在有效期内可以重复使用
+type udpTracker struct {
+	addr     string
+	mu       sync.Mutex
+	connID   uint64
+	connTime time.Time
+}
+
+var (
+	udpTrackersMu sync.Mutex
+	udpTrackers   = make(map[string]*udpTracker)
+)
+
+func getUDPTracker(addr string) *udpTracker {
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+	t, ok := udpTrackers[addr]
+	if !ok {
+		t = &udpTracker{addr: addr}
+		udpTrackers[addr] = t
+	}
+	return t
+}
+
+//udp tracker中一次scrape的结果
+type udpScrape struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+//udp tracker的announce请求
+type udpAnnounceReq struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Downloaded int64
+	Left       int64
+	Uploaded   int64
+	Event      uint32
+	Key        uint32
+	NumWant    int32
+	Port       uint16
+}
+
+//udp tracker的announce响应
+type udpAnnounceResp struct {
+	Interval int
+	Leechers int
+	Seeders  int
+	Peers    []peers.Peer
+}
+
+func newTransactionID() (uint32, error) {
+	var buf [4]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+//发送需要connection id的请求，每次尝试先拿connection id再发请求，都算在同一个超时里，超时后按2倍时间重试
+func (t *udpTracker) roundTrip(conn net.Conn, req []byte, action, tid uint32) ([]byte, error) {
+	for n := 0; n < udpAttempts; n++ {
+		deadline := time.Now().Add(udpTimeout << uint(n))
+		connID, err := t.connectionID(conn, deadline)
+		if err == errUDPTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		resp, err := t.exchange(conn, req, action, tid, deadline)
+		if err == errUDPTimeout {
+			continue
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("Tracker %s timeout after %d attempts", t.addr, udpAttempts)
+}
+
+//发送一次请求，等待同一transaction id、同一action的响应直到deadline
+func (t *udpTracker) exchange(conn net.Conn, req []byte, action, tid uint32, deadline time.Time) ([]byte, error) {
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(deadline)
+	for {
+		size, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+			continue
+		}
+
+		resp := buf[:size]
+		gotAction := binary.BigEndian.Uint32(resp[0:4])
+		if gotAction == udpActionError {
+			//可能是connection id失效了，下次重新connect
+			t.mu.Lock()
+			t.connID = 0
+			t.mu.Unlock()
+			return nil, &TrackerError{URL: "udp://" + t.addr, Reason: string(resp[8:])}
+		}
+		if gotAction != action {
+			continue
+		}
+		return append([]byte(nil), resp...), nil
+	}
+}
+
+//返回可用的connection id，过期或者没有时发一次connect，不自己重试
+func (t *udpTracker) connectionID(conn net.Conn, deadline time.Time) (uint64, error) {
+	t.mu.Lock()
+	if t.connID != 0 && time.Since(t.connTime) < udpConnIDTTL {
+		id := t.connID
+		t.mu.Unlock()
+		return id, nil
+	}
+	t.mu.Unlock()
+
+	tid, err := newTransactionID()
+	if err != nil {
+		return 0, err
+	}
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+
+	resp, err := t.exchange(conn, req, udpActionConnect, tid, deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("Tracker %s connect response too short", t.addr)
+	}
+
+	id := binary.BigEndian.Uint64(resp[8:16])
+	t.mu.Lock()
+	t.connID = id
+	t.connTime = time.Now()
+	t.mu.Unlock()
+	return id, nil
+}
+
+func (t *udpTracker) announce(ar *udpAnnounceReq) (*udpAnnounceResp, error) {
+	conn, err := net.Dial("udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tid, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	copy(req[16:36], ar.InfoHash[:])
+	copy(req[36:56], ar.PeerID[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(ar.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(ar.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(ar.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], ar.Event)
+	binary.BigEndian.PutUint32(req[84:88], 0)
+	binary.BigEndian.PutUint32(req[88:92], ar.Key)
+	binary.BigEndian.PutUint32(req[92:96], uint32(ar.NumWant))
+	binary.BigEndian.PutUint16(req[96:98], ar.Port)
+
+	resp, err := t.roundTrip(conn, req, udpActionAnnounce, tid)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("Tracker %s announce response too short", t.addr)
+	}
+
+	//通过IPv6连接的tracker返回的是18字节的peer
+	unmarshal := peers.Unmarshal
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = peers.Unmarshal6
+	}
+	list, err := unmarshal(resp[20:])
+	if err != nil {
+		return nil, err
+	}
+	return &udpAnnounceResp{
+		Interval: int(binary.BigEndian.Uint32(resp[8:12])),
+		Leechers: int(binary.BigEndian.Uint32(resp[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:20])),
+		Peers:    list,
+	}, nil
+}
+
+//一次可以scrape多个info hash，结果和请求的顺序一致
+func (t *udpTracker) scrape(infoHashes [][20]byte) ([]udpScrape, error) {
+	conn, err := net.Dial("udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tid, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	for i, h := range infoHashes {
+		copy(req[16+20*i:], h[:])
+	}
+
+	resp, err := t.roundTrip(conn, req, udpActionScrape, tid)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("Tracker %s scrape response too short", t.addr)
+	}
+
+	res := make([]udpScrape, len(infoHashes))
+	for i := range res {
+		off := 8 + 12*i
+		res[i] = udpScrape{
+			Seeders:   int(binary.BigEndian.Uint32(resp[off : off+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[off+4 : off+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[off+8 : off+12])),
+		}
+	}
+	return res, nil
+}
+
+//udp协议里事件用数字表示
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+//向udp://host:port形式的tracker请求peer
+func (torr *TorrentFile) announceUDP(announce string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	t := getUDPTracker(u.Host)
+	resp, err := t.announce(&udpAnnounceReq{
+		InfoHash:   torr.InfoHash,
+		PeerID:     req.PeerID,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		Uploaded:   req.Uploaded,
+		Event:      udpEvents[req.Event],
+		Key:        req.Key,
+		NumWant:    int32(req.NumWant),
+		Port:       req.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AnnounceResponse{
+		Interval:   time.Duration(resp.Interval) * time.Second,
+		Complete:   resp.Seeders,
+		Incomplete: resp.Leechers,
+		Peers:      resp.Peers,
+	}, nil
+}
@@ -0,0 +1,174 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bingnoi/bittorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//本地的udp tracker替身，handle根据收到的请求返回要回复的包
+func startUDPTracker(t *testing.T, handle func(req []byte) [][]byte) (*udpTracker, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, reply := range handle(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(reply, addr)
+			}
+		}
+	}()
+	return &udpTracker{addr: conn.LocalAddr().String()}, func() { conn.Close() }
+}
+
+func udpReply(action, tid uint32, body []byte) []byte {
+	reply := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(reply[0:4], action)
+	binary.BigEndian.PutUint32(reply[4:8], tid)
+	return append(reply, body...)
+}
+
+func connectReply(tid uint32, connID uint64) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, connID)
+	return udpReply(udpActionConnect, tid, body)
+}
+
+//interval 900，1个leecher，2个seeder，一个peer 127.0.0.1:6881
+func announceReply(tid uint32) []byte {
+	body := make([]byte, 12)
+	binary.BigEndian.PutUint32(body[0:4], 900)
+	binary.BigEndian.PutUint32(body[4:8], 1)
+	binary.BigEndian.PutUint32(body[8:12], 2)
+	body = append(body, 127, 0, 0, 1, 0x1a, 0xe1)
+	return udpReply(udpActionAnnounce, tid, body)
+}
+
+func requestTID(req []byte) uint32 {
+	return binary.BigEndian.Uint32(req[12:16])
+}
+
+func requestAction(req []byte) uint32 {
+	return binary.BigEndian.Uint32(req[8:12])
+}
+
+//按照BEP 15回复connect和announce，记录connect的次数
+func standardTracker(connects *int32) func(req []byte) [][]byte {
+	return func(req []byte) [][]byte {
+		if binary.BigEndian.Uint64(req[0:8]) == udpProtocolID && requestAction(req) == udpActionConnect {
+			atomic.AddInt32(connects, 1)
+			return [][]byte{connectReply(requestTID(req), 0x1234)}
+		}
+		if binary.BigEndian.Uint64(req[0:8]) != 0x1234 || requestAction(req) != udpActionAnnounce {
+			return nil
+		}
+		return [][]byte{announceReply(requestTID(req))}
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	var connects int32
+	tracker, stop := startUDPTracker(t, standardTracker(&connects))
+	defer stop()
+
+	resp, err := tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.Nil(t, err)
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, 1, resp.Leechers)
+	assert.Equal(t, 2, resp.Seeders)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, resp.Peers)
+
+	//connection id有效期内不重新connect
+	_, err = tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connects))
+}
+
+func TestUDPTransactionMismatch(t *testing.T) {
+	var connects int32
+	handle := standardTracker(&connects)
+	tracker, stop := startUDPTracker(t, func(req []byte) [][]byte {
+		replies := handle(req)
+		if requestAction(req) != udpActionAnnounce {
+			return replies
+		}
+		//先回一个别的transaction id的错误，应该被忽略
+		return append([][]byte{udpReply(udpActionError, requestTID(req)+1, []byte("not yours"))}, replies...)
+	})
+	defer stop()
+
+	resp, err := tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.Nil(t, err)
+	assert.Equal(t, 2, resp.Seeders)
+}
+
+func TestUDPErrorReply(t *testing.T) {
+	var connects int32
+	handle := standardTracker(&connects)
+	tracker, stop := startUDPTracker(t, func(req []byte) [][]byte {
+		if requestAction(req) == udpActionAnnounce {
+			return [][]byte{udpReply(udpActionError, requestTID(req), []byte("torrent not registered"))}
+		}
+		return handle(req)
+	})
+	defer stop()
+
+	_, err := tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.NotNil(t, err)
+	trackerErr, ok := err.(*TrackerError)
+	require.True(t, ok)
+	assert.Equal(t, "torrent not registered", trackerErr.Reason)
+
+	//出错之后不再信任原来的connection id
+	_, err = tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connects))
+}
+
+func TestUDPConnectionIDExpiry(t *testing.T) {
+	ttl := udpConnIDTTL
+	udpConnIDTTL = 50 * time.Millisecond
+	defer func() { udpConnIDTTL = ttl }()
+
+	var connects int32
+	tracker, stop := startUDPTracker(t, standardTracker(&connects))
+	defer stop()
+
+	_, err := tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	require.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connects))
+}
+
+func TestUDPTimeout(t *testing.T) {
+	timeout := udpTimeout
+	udpTimeout = 20 * time.Millisecond
+	defer func() { udpTimeout = timeout }()
+
+	var requests int32
+	tracker, stop := startUDPTracker(t, func(req []byte) [][]byte {
+		atomic.AddInt32(&requests, 1)
+		return nil
+	})
+	defer stop()
+
+	//没有回应的tracker只试udpAttempts次
+	start := time.Now()
+	_, err := tracker.announce(&udpAnnounceReq{InfoHash: [20]byte{1}, Port: Port})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(udpAttempts), atomic.LoadInt32(&requests))
+}
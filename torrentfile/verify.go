@@ -0,0 +1,87 @@
+package torrentfile
+
+import (
+	"log"
+	"os"
+
+	"github.com/bingnoi/bittorrent/p2p"
+	"github.com/bingnoi/bittorrent/storage"
+)
+
+//校验结果，Missing是磁盘上没有数据的piece，Corrupt是哈希对不上的piece
+type VerifyResult struct {
+	Pieces  int
+	Missing []int
+	Corrupt []int
+	Files   []FileStatus
+}
+
+//单个文件的校验情况
+type FileStatus struct {
+	Path    string
+	Missing int
+	Corrupt int
+}
+
+func (r *VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+//不下载任何东西，只把path下已有的数据按piece读出来和PieceHashes比较
+func (torr *TorrentFile) Verify(path string) (*VerifyResult, error) {
+	st, err := storage.OpenFileStorage(torr.storageFiles(path), torr.PieceLength)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	res := &VerifyResult{Pieces: len(torr.PieceHashes)}
+	for _, f := range torr.Files {
+		res.Files = append(res.Files, FileStatus{Path: torr.filePath(path, f)})
+	}
+
+	//磁盘上不存在或者长度不够的文件
+	absent := make([]bool, len(torr.Files))
+	for i, f := range torr.Files {
+		stat, err := os.Stat(torr.filePath(path, f))
+		absent[i] = err != nil || stat.Size() < int64(f.Length)
+	}
+
+	buf := make([]byte, torr.PieceLength)
+	for index, hash := range torr.PieceHashes {
+		begin, end := p2p.PieceBounds(index, torr.PieceLength, torr.Length)
+		piece := buf[:end-begin]
+
+		err := st.ReadPiece(index, piece)
+		switch {
+		case err == storage.ErrMissing:
+			res.Missing = append(res.Missing, index)
+			res.markFiles(torr, begin, end, absent)
+		case err != nil:
+			return nil, err
+		case p2p.CheckPiece(index, hash, piece) != nil:
+			res.Corrupt = append(res.Corrupt, index)
+			res.markFiles(torr, begin, end, nil)
+		}
+	}
+
+	log.Printf("Verify done, %d missing, %d corrupt of %d pieces\n", len(res.Missing), len(res.Corrupt), res.Pieces)
+	return res, nil
+}
+
+//把坏piece记到它覆盖到的文件上：absent为nil时是哈希不对，不知道是哪个文件坏了，每个文件都记一次；
+//否则是缺数据，只记到真正缺数据的文件上，跨文件边界的piece不会把完好的文件也算成缺失
+func (r *VerifyResult) markFiles(torr *TorrentFile, begin, end int, absent []bool) {
+	offset := 0
+	for i, f := range torr.Files {
+		fileEnd := offset + f.Length
+		if begin < fileEnd && end > offset {
+			if absent == nil {
+				r.Files[i].Corrupt++
+			} else if absent[i] {
+				r.Files[i].Missing++
+			}
+		}
+		offset = fileEnd
+	}
+}
@@ -0,0 +1,78 @@
+package torrentfile
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//在dir下生成随机内容的文件，返回每个文件的内容
+func writeFiles(t *testing.T, dir string, names []string, sizes []int) [][]byte {
+	var datas [][]byte
+	for i, name := range names {
+		data := make([]byte, sizes[i])
+		rand.Read(data)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+		datas = append(datas, data)
+	}
+	return datas
+}
+
+//用dir/src下的文件生成torrent并解析
+func createTorrent(t *testing.T, dir string, names []string, sizes []int, pieceLength int) (TorrentFile, string, [][]byte) {
+	src := filepath.Join(dir, "src")
+	require.Nil(t, os.MkdirAll(src, 0755))
+	datas := writeFiles(t, src, names, sizes)
+
+	buf, err := Create(src, CreateOptions{PieceLength: pieceLength})
+	require.Nil(t, err)
+	path := filepath.Join(dir, "test.torrent")
+	require.Nil(t, ioutil.WriteFile(path, buf, 0644))
+
+	torr, err := Open(path)
+	require.Nil(t, err)
+	return torr, src, datas
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	//piece 1跨越a和b两个文件
+	torr, src, _ := createTorrent(t, dir, []string{"a", "b"}, []int{40000, 30000}, 32768)
+
+	res, err := torr.Verify(src)
+	require.Nil(t, err)
+	assert.True(t, res.OK())
+	assert.Equal(t, 3, res.Pieces)
+
+	//b不存在时跨文件的piece只算b缺失
+	require.Nil(t, os.Rename(filepath.Join(src, "b"), filepath.Join(dir, "b")))
+	res, err = torr.Verify(src)
+	require.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, res.Missing)
+	assert.Empty(t, res.Corrupt)
+	assert.Equal(t, 0, res.Files[0].Missing)
+	assert.Equal(t, 2, res.Files[1].Missing)
+
+	//哈希不对时不知道是哪个文件坏了，两个文件都记上
+	require.Nil(t, os.Rename(filepath.Join(dir, "b"), filepath.Join(src, "b")))
+	f, err := os.OpenFile(filepath.Join(src, "a"), os.O_RDWR, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 35000)
+	require.Nil(t, err)
+	f.Close()
+
+	res, err = torr.Verify(src)
+	require.Nil(t, err)
+	assert.Empty(t, res.Missing)
+	assert.Equal(t, []int{1}, res.Corrupt)
+	assert.Equal(t, 1, res.Files[0].Corrupt)
+	assert.Equal(t, 1, res.Files[1].Corrupt)
+}